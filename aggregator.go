@@ -0,0 +1,46 @@
+// Copyright (c) 2018, RetailNext, Inc.
+// All rights reserved.
+
+package hllpp
+
+import "fmt"
+
+// KeyedAggregator merges a stream of marshaled estimators into one estimator
+// per key. It is not safe to use from multiple goroutines at once.
+type KeyedAggregator struct {
+	groups map[string]*HLLPP
+}
+
+// NewKeyedAggregator creates an empty KeyedAggregator.
+func NewKeyedAggregator() *KeyedAggregator {
+	return &KeyedAggregator{groups: make(map[string]*HLLPP)}
+}
+
+// Add unmarshals data (see Unmarshal) and merges it into key's estimator. The
+// first estimator added for a key determines the p and p' values all later
+// ones for that key must have.
+func (a *KeyedAggregator) Add(key string, data []byte) error {
+	h, err := Unmarshal(data)
+	if err != nil {
+		return fmt.Errorf("key %q: %s", key, err)
+	}
+
+	acc := a.groups[key]
+	if acc == nil {
+		a.groups[key] = h
+		return nil
+	}
+
+	if err := acc.Merge(h); err != nil {
+		return fmt.Errorf("key %q: %s", key, err)
+	}
+	return nil
+}
+
+// Flush returns the merged estimator for each key added since the last Flush,
+// and resets a.
+func (a *KeyedAggregator) Flush() map[string]*HLLPP {
+	groups := a.groups
+	a.groups = make(map[string]*HLLPP)
+	return groups
+}
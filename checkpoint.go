@@ -0,0 +1,141 @@
+// Copyright (c) 2018, RetailNext, Inc.
+// All rights reserved.
+
+package hllpp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// CheckpointMarshal marshals the changes to h since the previous call, e.g.
+// for write-ahead logging. The first call marshals all of h (see Marshal).
+// Later calls only marshal the sparse entries or dense registers that
+// increased since the previous call, along with the increase in volume
+// counters (see Config.TrackVolume) and the MinHash sketch (see
+// Config.MinHashSize). If h converted to dense, its precision was lowered, or
+// it was reset (see ResetDense) since the previous call, all of h is
+// marshaled again. Use Replay to reconstruct h from the results; Unmarshal,
+// CountFromMarshaled and the like reject the deltas.
+//
+// h keeps a copy of its data as of the previous call, doubling its memory
+// use. h can't use banks.
+func (h *HLLPP) CheckpointMarshal() ([]byte, error) {
+	if h.banks != nil {
+		return nil, errors.New("CheckpointMarshal does not support banks")
+	}
+
+	if h.sparse {
+		h.flushTmpSet()
+	}
+
+	last := h.checkpoint
+	h.checkpoint = h.clone()
+	h.checkpoint.checkpoint = nil
+
+	if last == nil || last.p != h.p || last.sparse != h.sparse {
+		return h.Marshal(), nil
+	}
+
+	delta := &HLLPP{
+		p:               h.p,
+		pp:              h.pp,
+		m:               h.m,
+		sparse:          h.sparse,
+		bitsPerRegister: h.bitsPerRegister,
+		minHashK:        h.minHashK,
+		minHash:         h.minHash,
+	}
+
+	if h.sparse {
+		// An index's entry only changes if its rho increases, so entries
+		// that are identical to the previous checkpoint's are unchanged.
+		writer := newSparseWriter()
+		reader, lastReader := newSparseReader(h.data), newSparseReader(last.data)
+		for !reader.Done() {
+			k := reader.Next()
+			idx := h.getIndex(k, h.pp)
+			for !lastReader.Done() && h.getIndex(lastReader.Peek(), h.pp) < idx {
+				lastReader.Advance()
+			}
+			if !lastReader.Done() && lastReader.Peek() == k {
+				continue
+			}
+			writer.AppendDistinct(k)
+		}
+		delta.data = writer.Bytes()
+		delta.sparseLength = writer.Len()
+	} else {
+		// unchanged registers are left at zero, which MarshalCompact
+		// stores compactly
+		delta.data = make([]byte, len(h.data))
+		for i := uint32(0); i < h.m; i++ {
+			rho := getRegister(h.data, h.bitsPerRegister, i)
+			if rho > getRegister(last.data, last.bitsPerRegister, i) {
+				setRegister(delta.data, h.bitsPerRegister, i, rho)
+			}
+		}
+	}
+
+	if h.volume != nil {
+		delta.volume = make([]uint16, len(h.volume))
+		for i, v := range h.volume {
+			delta.volume[i] = v - last.volume[i]
+		}
+	}
+
+	data := delta.MarshalCompact()
+	binary.BigEndian.PutUint16(data[0:], marshalVersionExtended)
+	binary.BigEndian.PutUint16(data[6:], binary.BigEndian.Uint16(data[6:])|marshalFlagCheckpointDelta)
+	return data, nil
+}
+
+// Replay reconstructs an HLLPP from the results of CheckpointMarshal: base is
+// the result of the first call, and deltas the results of later calls, in
+// order.
+func Replay(base []byte, deltas ...[]byte) (*HLLPP, error) {
+	h, err := Unmarshal(base)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, data := range deltas {
+		delta, isDelta, err := unmarshalCheckpoint(data)
+		if err != nil {
+			return nil, fmt.Errorf("delta %d: %w", i, err)
+		}
+
+		// CheckpointMarshal marshals all of h when changes can't be
+		// merged (see CheckpointMarshal), and that replaces what we have so
+		// far
+		if !isDelta {
+			h = delta
+			continue
+		}
+
+		if err := h.Merge(delta); err != nil {
+			return nil, fmt.Errorf("delta %d: %w", i, err)
+		}
+	}
+
+	return h, nil
+}
+
+// unmarshalCheckpoint unmarshals a result of CheckpointMarshal, which is
+// either a delta (which Unmarshal rejects) or a full estimator.
+func unmarshalCheckpoint(data []byte) (h *HLLPP, isDelta bool, err error) {
+	hdr, err := parseHeader(data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	isDelta = hdr.version >= marshalVersionExtended && hdr.flags&marshalFlagCheckpointDelta > 0
+	if isDelta {
+		data = append([]byte(nil), data...)
+		binary.BigEndian.PutUint16(data[6:], hdr.flags&^marshalFlagCheckpointDelta)
+	}
+
+	h, err = Unmarshal(data)
+	return h, isDelta, err
+}
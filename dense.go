@@ -83,6 +83,8 @@ func (h *HLLPP) estimateBias(e float64) float64 {
 	e1, e2 := estimates[index-1], estimates[index]
 	b1, b2 := biases[index-1], biases[index]
 
+	// the float64 conversions prevent fusing multiplies and adds, which some
+	// architectures would round differently
 	r := (e - e1) / (e2 - e1)
-	return b1*(1-r) + b2*r
+	return float64(b1*(1-r)) + float64(b2*r)
 }
@@ -0,0 +1,43 @@
+// Copyright (c) 2018, RetailNext, Inc.
+// All rights reserved.
+
+package hllpp
+
+import "fmt"
+
+// EWMAEstimator smooths a series of cardinality estimates (e.g. one HLLPP per
+// time bucket) with an exponentially weighted moving average. It doesn't
+// merge the estimators, it just averages their counts.
+type EWMAEstimator struct {
+	alpha float64
+	value float64
+	init  bool
+}
+
+// NewEWMAEstimator creates an EWMAEstimator with smoothing factor alpha, which
+// must be in the range (0..1]. Each update moves the smoothed value alpha of
+// the way towards the new count, so bigger values of alpha smooth less.
+func NewEWMAEstimator(alpha float64) (*EWMAEstimator, error) {
+	if !(alpha > 0 && alpha <= 1) {
+		return nil, fmt.Errorf("invalid alpha: %f", alpha)
+	}
+	return &EWMAEstimator{alpha: alpha}, nil
+}
+
+// Update folds h.Count() into the smoothed value and returns the new smoothed
+// value. The first update sets the smoothed value to h.Count().
+func (e *EWMAEstimator) Update(h *HLLPP) float64 {
+	count := float64(h.Count())
+	if !e.init {
+		e.value = count
+		e.init = true
+	} else {
+		e.value += e.alpha * (count - e.value)
+	}
+	return e.value
+}
+
+// Value returns the current smoothed value (0 before the first Update).
+func (e *EWMAEstimator) Value() float64 {
+	return e.value
+}
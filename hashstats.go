@@ -0,0 +1,40 @@
+// Copyright (c) 2018, RetailNext, Inc.
+// All rights reserved.
+
+package hllpp
+
+import "errors"
+
+// HashStats describes the hashes of the values added to an HLLPP created with
+// Config.Debug.
+type HashStats struct {
+	// Count is the number of hashes seen, and Min and Max are the smallest
+	// and biggest of them.
+	Count    uint64
+	Min, Max uint64
+
+	// Histogram counts the hashes by their top 3 bits (i.e. the top byte in
+	// buckets of 32). A good hash function gives roughly equal counts.
+	Histogram [8]uint64
+}
+
+func (s *HashStats) add(x uint64) {
+	if s.Count == 0 || x < s.Min {
+		s.Min = x
+	}
+	if x > s.Max {
+		s.Max = x
+	}
+	s.Count++
+	s.Histogram[x>>61]++
+}
+
+// HashStats returns statistics about the hashes of the values added to h via
+// Add since it was created or last reset (see Reset). h must have been
+// created with Config.Debug. Merged estimators' values aren't included.
+func (h *HLLPP) HashStats() (HashStats, error) {
+	if h.hashStats == nil {
+		return HashStats{}, errors.New("Config.Debug not enabled")
+	}
+	return *h.hashStats, nil
+}
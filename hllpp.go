@@ -8,9 +8,13 @@
 package hllpp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
+	"math/bits"
+	"math/rand"
+	"unsafe"
 )
 
 // HLLPP represents a single HyperLogLog++ estimator. Create one via New().
@@ -35,173 +39,1887 @@ type HLLPP struct {
 	// p' and m'
 	pp uint8
 	mp uint32
+
+	// skip linear counting and bias correction in Count
+	rawEstimateOnly bool
+
+	// additional register banks (see Config.Banks)
+	banks []*HLLPP
+
+	// per register tag+1 of the MergeTagged call that set the register's
+	// current value (0 means untagged). Only used in dense mode.
+	tags []uint16
+
+	// lower p to match lower precision estimators in Merge
+	downgradeOnMerge bool
+
+	// memory cap in bytes (see Config.MaxBytes), 0 if none
+	maxBytes int
+
+	// make Add of nil/empty a no-op
+	ignoreEmpty bool
+
+	// see Config.LinearCountingMaxFactor
+	linearCountingMaxFactor float64
+
+	// saturating per register count of Adds (see Config.TrackVolume), nil
+	// if not tracking volume
+	volume []uint16
+
+	// bumped by everything that modifies h, so Count can cache its result
+	// (countVersion is version+1 of the cached count, 0 if none)
+	version      uint64
+	countVersion uint64
+	cachedCount  uint64
+
+	// the number of distinct p' indexes in the sparse data and tmpSet, for
+	// AddAndDelta (pendingLengthVersion is version+1 when it is valid)
+	pendingLength        uint32
+	pendingLengthVersion uint64
+
+	// see Config.OnRegisterUpdate and Config.OnSparseUpdate
+	onRegisterUpdate func(index uint32, old, new uint8)
+	onSparseUpdate   func(index uint32, old, new uint8)
+
+	// see Config.Debug, nil if not enabled
+	hashStats *HashStats
+
+	// see Config.AutoFlushEvery
+	autoFlushEvery int
+
+	// see Config.DeterministicCount
+	deterministicCount bool
+
+	// see Config.AssertMonotonic: the register sum at the last check, and p
+	// at the time (0 before the first check)
+	assertMonotonic bool
+	monotonicSum    float64
+	monotonicP      uint8
+
+	// the smallest distinct hashes added, sorted, up to minHashK of them
+	// (see Config.MinHashSize)
+	minHashK int
+	minHash  []uint64
+
+	// a copy of h as of the last CheckpointMarshal, nil before the first
+	checkpoint *HLLPP
+}
+
+// Approximate size in bytes of h (used for testing).
+func (h *HLLPP) memSize() int {
+	return cap(h.data) + 4*cap(h.tmpSet) + 20
+}
+
+// Precision returns h's precision (p).
+func (h *HLLPP) Precision() uint8 {
+	return h.p
+}
+
+// SparsePrecision returns h's precision in sparse mode (p').
+func (h *HLLPP) SparsePrecision() uint8 {
+	return h.pp
+}
+
+// IsSparse reports whether h is using the sparse representation.
+func (h *HLLPP) IsSparse() bool {
+	return h.sparse
+}
+
+// BitsPerRegister returns the width of h's dense registers (5 or 6), or 0 if
+// h is sparse.
+func (h *HLLPP) BitsPerRegister() uint32 {
+	return h.bitsPerRegister
+}
+
+// Data returns a copy of h's sparse or dense data, as found in Marshal's
+// output after the header, but without volume counters and always with
+// packed dense registers. Buffered sparse values are flushed first, which can
+// convert h to dense, so call IsSparse and BitsPerRegister after Data.
+// NewFromParts reverses this.
+func (h *HLLPP) Data() []byte {
+	if h.sparse {
+		h.flushTmpSet()
+	}
+	return append([]byte(nil), h.data...)
+}
+
+// NewFromParts creates a HyperLogLog++ estimator from data returned by Data,
+// and the precision, sparse precision, representation and bits per register
+// of the estimator it came from. data is copied.
+func NewFromParts(p, pp uint8, sparse bool, bitsPerRegister uint32, data []byte) (*HLLPP, error) {
+	h, err := NewWithConfig(Config{Precision: p, SparsePrecision: pp})
+	if err != nil {
+		return nil, err
+	}
+
+	h.sparse = sparse
+	h.bitsPerRegister = bitsPerRegister
+	h.data = append([]byte(nil), data...)
+
+	if sparse {
+		if h.sparseLength, err = sparseDataLength(h.data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := h.Validate(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// ExpectedDenseBytes returns the length of h's dense register data: the
+// current length if h is dense, otherwise the length with 6 bits per register,
+// which is the most the dense data can grow to once h converts.
+func (h *HLLPP) ExpectedDenseBytes() int {
+	if h.sparse {
+		return int(h.m * 6 / 8)
+	}
+	return int(h.m * h.bitsPerRegister / 8)
+}
+
+// New creates a HyperLogLog++ estimator with p=14, p'=20.
+func New() *HLLPP {
+	return MustNewWithConfig(Config{})
+}
+
+// Config is used to set configurable fields on a HyperLogLog++ via
+// NewWithConfig.
+type Config struct {
+	// Precision (p). Must be in the range [4..16]. This value can be used
+	// to adjust the typical relative error of the estimate. Space requirements
+	// grow exponentially as this value is increased. Defaults to 14, the
+	// recommended value, which gives an expected error of about 0.8%
+	Precision uint8
+
+	// Precision in sparse mode (p'). Must be in the range [p..25] for this
+	// implementation. This value can be used to adjust the typical relative
+	// error of the estimate when using the sparse representation (typically
+	// for cardinalities below 8000 at p'=20). Lowering p' will allow the
+	// estimator to remain in sparse mode longer, but will increase the relative
+	// error. The HyperLogLog++ paper recommends 20 or 25. Defaults to 20 since
+	// that still gives you a much lower error vs. p=14, but saves a significant
+	// amount of space vs. p'=25 (20-25% for cardinalities less than 5000).
+	SparsePrecision uint8
+
+	// RawEstimateOnly disables the HyperLogLog++ corrections in Count. Both
+	// the linear counting used for small cardinalities and the empirical bias
+	// correction are skipped, so Count always returns the plain harmonic mean
+	// estimate of the original HyperLogLog algorithm (computed from the
+	// registers at precision p, even in sparse mode). This is mostly useful
+	// for comparing against the original algorithm; the estimate is badly
+	// biased for small cardinalities.
+	RawEstimateOnly bool
+
+	// Banks is the number of independent register banks to use (stochastic
+	// averaging). Must be 1, 2, 4 or 8. Each bank is fed every value, with
+	// the hash remixed differently per bank so the banks' estimates are
+	// independent, and Count returns the average of the banks' estimates. This reduces
+	// the variance of the estimate for small p at the cost of Banks times the
+	// memory. Banked estimators skip the sparse representation, and can only
+	// be merged with estimators using the same number of banks. Defaults to
+	// 1.
+	Banks int
+
+	// DowngradeOnMerge allows Merge to merge an estimator with a lower
+	// precision (p) into this one. The registers can't be split to upscale
+	// the other estimator, so instead this estimator is permanently folded
+	// down to the other's precision before merging, losing accuracy. Without
+	// this, Merge returns an error when the precisions differ. p' must still
+	// match.
+	DowngradeOnMerge bool
+
+	// MaxBytes caps the size of the estimator's data. When the sparse data
+	// (including buffered values) would exceed MaxBytes, the estimator
+	// converts to the dense representation early, and if the dense registers
+	// at precision p don't fit either, it permanently folds itself down to
+	// the biggest p that does fit. Each fold halves the number of registers,
+	// increasing the expected error by a factor of sqrt(2), and a folded
+	// estimator can only be merged with estimators of the same lower p (see
+	// DowngradeOnMerge). MaxBytes must be at least 12 (enough for p=4), and
+	// can't be used with Banks. Defaults to 0, meaning no cap.
+	MaxBytes int
+
+	// OnRegisterUpdate, if not nil, is called whenever a dense register's
+	// value increases (via Add, Merge etc.), with the register's index and
+	// its old and new values. It is not called when registers are rebuilt
+	// wholesale, such as when converting from sparse to dense or folding to
+	// a lower precision.
+	OnRegisterUpdate func(index uint32, old, new uint8)
+
+	// OnSparseUpdate, if not nil, is called whenever buffered sparse values
+	// are merged into the sparse data, once for each p' index that is new
+	// (old is 0) or whose value increased. The values are rho with respect to
+	// p, as returned by DecodeSparse. Since values are buffered, this happens
+	// in batches rather than on every Add. Neither hook can be used with
+	// Banks.
+	OnSparseUpdate func(index uint32, old, new uint8)
+
+	// IgnoreEmpty makes Add a no-op for nil or empty values. By default, the
+	// empty value is counted like any other distinct value.
+	IgnoreEmpty bool
+
+	// StartDense skips the sparse representation, allocating the dense
+	// registers up front. This avoids the cost of converting from sparse to
+	// dense for estimators that will see high cardinalities anyway, at the
+	// cost of memory and accuracy for low cardinalities.
+	StartDense bool
+
+	// TrackVolume enables a 16 bit counter per register (2*m bytes) counting
+	// how many values added to the estimator landed in that register,
+	// saturating at 65535. VolumeEstimate sums the counters to give the total
+	// number of values added (not just distinct values). Counters are summed
+	// by Merge when both estimators track volume, and are included by
+	// Marshal.
+	TrackVolume bool
+
+	// LinearCountingMaxFactor, if not 0, makes Count use linear counting in
+	// dense mode whenever the linear counting estimate is below
+	// LinearCountingMaxFactor*m, instead of below the empirical thresholds
+	// from the HyperLogLog++ paper (which are between roughly 0.6m and 1.8m,
+	// depending on p). Raising it extends the range linear counting is used
+	// for. Must not be negative.
+	LinearCountingMaxFactor float64
+
+	// AutoFlushEvery, if not 0, makes a sparse estimator merge its buffer of
+	// recently added values into the sparse data whenever the buffer reaches
+	// AutoFlushEvery values, instead of only when it reaches a quarter of the
+	// dense size. This spreads the cost of merging more evenly across Adds
+	// (e.g. so a periodic Marshal doesn't have to flush a big buffer), at the
+	// cost of more CPU overall. Must not be negative.
+	AutoFlushEvery int
+
+	// MinHashSize, if not 0, keeps the MinHashSize smallest distinct hashes of
+	// the added values (a bottom-k MinHash sketch, 8 bytes per hash)
+	// alongside the registers. IntersectionCount uses them to estimate small
+	// intersections much more accurately than inclusion-exclusion. Merge
+	// keeps the MinHash only if the other estimator has one too, and Marshal
+	// includes it. Must be in the range [0..65535].
+	MinHashSize int
+
+	// DeterministicCount makes Count return exactly the same result on every
+	// architecture for the same registers, e.g. for tests with golden counts.
+	// Normally a logarithm in the linear counting estimate is computed by
+	// assembly on some architectures (such as amd64) and in Go on others,
+	// which can differ in the last bit and so occasionally round the count
+	// differently. With DeterministicCount it is always computed in Go, which
+	// is slightly slower. The rest of the estimate only uses basic float64
+	// arithmetic, which is always deterministic. It is not preserved by
+	// Marshal.
+	DeterministicCount bool
+
+	// AssertMonotonic makes Add and Merge panic if any register is lower than
+	// after the previous Add or Merge, which can't happen unless h's data was
+	// corrupted. It checks the sum over all the registers after every Add and
+	// Merge, which is very slow. Lowering the precision (see
+	// Config.DowngradeOnMerge and Config.MaxBytes) or calling Reset or
+	// ResetDense starts over from the new registers, so it doesn't catch an
+	// accidental Reset.
+	AssertMonotonic bool
+
+	// Debug makes Add keep statistics about the hashes of added values, for
+	// diagnosing a poor hash distribution (see HashStats). This slows down
+	// Add.
+	Debug bool
+}
+
+// NewWithConfig creates a HyperLogLog++ estimator with the given Config.
+func NewWithConfig(c Config) (*HLLPP, error) {
+	if c.Precision == 0 {
+		c.Precision = 14
+	}
+
+	if c.SparsePrecision == 0 {
+		c.SparsePrecision = 20
+	}
+
+	if c.Banks == 0 {
+		c.Banks = 1
+	}
+
+	p, pp := c.Precision, c.SparsePrecision
+	if p < 4 || p > 16 || pp < p || pp > 25 {
+		return nil, fmt.Errorf("invalid precision (p: %d, p': %d)", p, pp)
+	}
+
+	switch c.Banks {
+	case 1, 2, 4, 8:
+	default:
+		return nil, fmt.Errorf("invalid number of banks: %d", c.Banks)
+	}
+
+	if c.LinearCountingMaxFactor < 0 {
+		return nil, fmt.Errorf("invalid linear counting max factor: %f", c.LinearCountingMaxFactor)
+	}
+
+	if c.MinHashSize < 0 || c.MinHashSize > math.MaxUint16 {
+		return nil, fmt.Errorf("invalid MinHash size: %d", c.MinHashSize)
+	}
+
+	if c.AutoFlushEvery < 0 {
+		return nil, fmt.Errorf("invalid auto flush interval: %d", c.AutoFlushEvery)
+	}
+
+	if c.MaxBytes < 0 || c.MaxBytes > 0 && c.MaxBytes < 12 {
+		return nil, fmt.Errorf("invalid max bytes: %d", c.MaxBytes)
+	}
+
+	if c.MaxBytes > 0 && c.Banks > 1 {
+		return nil, errors.New("MaxBytes can't be used with banks")
+	}
+
+	if (c.OnRegisterUpdate != nil || c.OnSparseUpdate != nil) && c.Banks > 1 {
+		return nil, errors.New("update hooks can't be used with banks")
+	}
+
+	newHLLPP := func() *HLLPP {
+		return &HLLPP{
+			p:      p,
+			pp:     pp,
+			m:      1 << p,
+			mp:     1 << pp,
+			sparse: true,
+
+			rawEstimateOnly:  c.RawEstimateOnly,
+			downgradeOnMerge: c.DowngradeOnMerge,
+			maxBytes:         c.MaxBytes,
+			onRegisterUpdate: c.OnRegisterUpdate,
+			onSparseUpdate:   c.OnSparseUpdate,
+			ignoreEmpty:      c.IgnoreEmpty,
+			autoFlushEvery:   c.AutoFlushEvery,
+			minHashK:         c.MinHashSize,
+
+			deterministicCount: c.DeterministicCount,
+			assertMonotonic:    c.AssertMonotonic,
+
+			linearCountingMaxFactor: c.LinearCountingMaxFactor,
+		}
+	}
+
+	h := newHLLPP()
+
+	if c.TrackVolume {
+		h.volume = make([]uint16, h.m)
+	}
+
+	if c.Debug {
+		h.hashStats = &HashStats{}
+	}
+
+	if c.StartDense {
+		h.toNormal()
+	}
+
+	if c.Banks > 1 {
+		h.toNormal()
+		for i := 1; i < c.Banks; i++ {
+			bank := newHLLPP()
+			bank.toNormal()
+			h.banks = append(h.banks, bank)
+		}
+	}
+
+	return h, nil
+}
+
+// MustNewWithConfig is like NewWithConfig, but panics if c is invalid.
+func MustNewWithConfig(c Config) *HLLPP {
+	h, err := NewWithConfig(c)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// SetDenseData creates a dense HyperLogLog++ estimator with precision p (and the
+// default p') directly from packed register data, as found in the dense
+// representation of this package's marshal format. bitsPerRegister must be 5
+// or 6, and len(data) must be m*bitsPerRegister/8. data is not copied or
+// validated beyond its length, so the caller must not modify it afterwards.
+func SetDenseData(p uint8, bitsPerRegister uint32, data []byte) (*HLLPP, error) {
+	h, err := NewWithConfig(Config{Precision: p})
+	if err != nil {
+		return nil, err
+	}
+
+	if bitsPerRegister != 5 && bitsPerRegister != 6 {
+		return nil, fmt.Errorf("invalid bits per register: %d", bitsPerRegister)
+	}
+
+	if uint32(len(data)) != h.m*bitsPerRegister/8 {
+		return nil, fmt.Errorf("wrong data length for p=%d, %d bits per register: %d", p, bitsPerRegister, len(data))
+	}
+
+	h.sparse = false
+	h.bitsPerRegister = bitsPerRegister
+	h.data = data
+
+	return h, nil
+}
+
+// Add will hash v and add the result to the HyperLogLog++ estimator h. hllpp
+// uses a built-in non-streaming implementation of murmur3. nil and empty
+// values are the same distinct value, and are counted unless h was created
+// with Config.IgnoreEmpty.
+func (h *HLLPP) Add(v []byte) {
+	if len(v) == 0 && h.ignoreEmpty {
+		return
+	}
+
+	h.addValueHash(murmurSum64(v))
+}
+
+// AddString is the same as Add([]byte(s)), but hashes s directly rather than
+// copying it into a new byte slice.
+func (h *HLLPP) AddString(s string) {
+	h.Add(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// AddUint32 adds v to h, hashing it with a fast integer mixing function
+// (murmur3's 64 bit finalizer) instead of murmur3 over v's bytes. This is
+// much faster than Add for counting distinct integer IDs, but the hashes are
+// different, so a given ID must always be added via AddUint32 (both to h and
+// to any estimator merged with h) to be counted once.
+func (h *HLLPP) AddUint32(v uint32) {
+	// the finalizer maps 0 to 0, which would give ID 0 the maximum rho, so
+	// mix in a constant (the 64 bit golden ratio) first
+	h.addValueHash(murmurFmix64(uint64(v) ^ 0x9e3779b97f4a7c15))
+}
+
+// AddUint64 adds x to h as an already computed 64 bit hash, skipping hashing
+// entirely, e.g. for input that was hashed upstream. x is used exactly like
+// the hash Add computes for a value, so its bits must be uniformly
+// distributed. Hashes from a different hash function than Add's won't match
+// Add's for the same values, so mixing AddUint64 with Add (on h or any
+// estimator merged with h) is only correct if the caller's hashes are
+// consistent with Add's murmur3.
+func (h *HLLPP) AddUint64(x uint64) {
+	h.addValueHash(x)
+}
+
+// addValueHash adds the hash x of a value, splitting it between the banks if
+// there are any.
+func (h *HLLPP) addValueHash(x uint64) {
+	if h.hashStats != nil {
+		h.hashStats.add(x)
+	}
+
+	if h.minHashK > 0 {
+		h.addMinHash(x)
+	}
+
+	if h.assertMonotonic {
+		defer h.checkMonotonic()
+	}
+
+	h.addHash(x)
+	for i, bank := range h.banks {
+		bank.addHash(bankHash(x, i))
+	}
+}
+
+// checkMonotonic panics if h's register sum went up, i.e. some register went
+// down, since the last check (see Config.AssertMonotonic).
+func (h *HLLPP) checkMonotonic() {
+	sum, _ := h.registerSum()
+
+	// allow for rounding differences between the sparse and dense sums
+	if h.monotonicP == h.p && sum > h.monotonicSum*(1+1e-12) {
+		panic(fmt.Sprintf("hllpp: registers decreased (register sum went from %v to %v)", h.monotonicSum, sum))
+	}
+
+	h.monotonicSum, h.monotonicP = sum, h.p
+}
+
+// NewDenseFromRegisters creates a dense HyperLogLog++ estimator with precision
+// p (and the default p') from unpacked register values, one per register (see
+// DenseRegisters). len(registers) must be 2^p, and each value must be at most
+// 65-p.
+func NewDenseFromRegisters(p uint8, registers []uint8) (*HLLPP, error) {
+	h, err := NewWithConfig(Config{Precision: p, StartDense: true})
+	if err != nil {
+		return nil, err
+	}
+
+	if uint32(len(registers)) != h.m {
+		return nil, fmt.Errorf("wrong number of registers for p=%d: %d", p, len(registers))
+	}
+
+	maxRho := 64 - p + 1
+	for i, rho := range registers {
+		if rho > maxRho {
+			return nil, fmt.Errorf("register %d out of range: %d", i, rho)
+		}
+		h.updateRegisterIfBigger(uint32(i), rho)
+	}
+
+	return h, nil
+}
+
+// DenseRegisters returns h's registers unpacked, one value per register. h
+// must be dense.
+func (h *HLLPP) DenseRegisters() ([]uint8, error) {
+	if h.sparse {
+		return nil, errors.New("HLLPP is sparse")
+	}
+
+	registers := make([]uint8, h.m)
+	for i := range registers {
+		registers[i] = getRegister(h.data, h.bitsPerRegister, uint32(i))
+	}
+	return registers, nil
+}
+
+// AddAll adds every value received from ch (see Add), returning once ch is
+// closed.
+func (h *HLLPP) AddAll(ch <-chan []byte) {
+	for v := range ch {
+		h.Add(v)
+	}
+}
+
+// AddAllContext is like AddAll, but stops early and returns ctx.Err() if ctx
+// is done before ch is closed. Values still in ch are not added.
+func (h *HLLPP) AddAllContext(ctx context.Context, ch <-chan []byte) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case v, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			h.Add(v)
+		}
+	}
+}
+
+// ExportDense8 returns h's registers with one byte per register (m bytes),
+// regardless of how they are packed internally. If h is sparse, the registers
+// are computed from a dense copy, and h isn't converted.
+func (h *HLLPP) ExportDense8() []byte {
+	dense := h
+	if h.sparse {
+		dense = h.clone()
+		dense.flushTmpSet()
+		dense.toNormal()
+	}
+
+	registers, _ := dense.DenseRegisters()
+	return registers
+}
+
+// AddRepeated is equivalent to calling Add(v) times times, but only hashes
+// and adds v once (adding the same value again can't change the registers),
+// and then adds the remaining repeats to the volume counters (see
+// Config.TrackVolume). It does nothing if times is not positive.
+func (h *HLLPP) AddRepeated(v []byte, times int) {
+	if times <= 0 || len(v) == 0 && h.ignoreEmpty {
+		return
+	}
+
+	x := murmurSum64(v)
+	h.addValueHash(x)
+
+	if h.volume != nil && times > 1 {
+		repeats := uint16(math.MaxUint16)
+		if times-1 < math.MaxUint16 {
+			repeats = uint16(times - 1)
+		}
+		idx := sliceBits64(x, 63, 64-h.p)
+		h.volume[idx] = addVolume(h.volume[idx], repeats)
+	}
+}
+
+// AddAndDelta adds v like Add, and returns the resulting change in Count.
+// Most values don't change any register, so the delta is usually 0 with an
+// occasional bigger jump, which makes it noisy for a single value but
+// unbiased when summed over many. In sparse mode, it only checks whether v
+// added a new sparse index, which takes time proportional to the size of the
+// sparse data. In dense mode, the count is cached between calls, and
+// recomputed (in time proportional to m) only if v changed a register.
+func (h *HLLPP) AddAndDelta(v []byte) (delta int64) {
+	if !h.sparse || h.rawEstimateOnly || len(v) == 0 && h.ignoreEmpty {
+		before := h.Count()
+		h.Add(v)
+		return int64(h.Count()) - int64(before)
+	}
+
+	// The sparse count is linear counting over the distinct p' indexes, so
+	// tracking their number avoids flushing (which rewrites the sparse data)
+	// to recount on every call.
+	if h.pendingLengthVersion != h.version+1 {
+		h.pendingLength, _, _ = h.pendingSparse()
+	}
+	length := h.pendingLength
+	before := h.linearCounting(h.mp, h.mp-length)
+
+	x := murmurSum64(v)
+	if !h.hasSparseIndex(h.getIndex(h.encodeHash(x), h.pp)) {
+		length++
+	}
+	h.addValueHash(x)
+
+	if !h.sparse {
+		return int64(h.Count()) - int64(before)
+	}
+
+	h.pendingLength, h.pendingLengthVersion = length, h.version+1
+	return int64(h.linearCounting(h.mp, h.mp-length)) - int64(before)
+}
+
+// bankHash returns the full 64 bit hash that bank i (h.banks[i]) uses for
+// the value hash x. x is remixed with a different constant per bank (based on
+// the 64 bit golden ratio), so each bank sees an independent hash.
+func bankHash(x uint64, i int) uint64 {
+	return murmurFmix64(x ^ uint64(i+1)*0x9e3779b97f4a7c15)
+}
+
+func (h *HLLPP) addHash(x uint64) {
+	// dense registers bump the version themselves only if they change, so
+	// the cached count survives values that don't change h
+	if h.sparse || h.banks != nil {
+		h.version++
+	}
+
+	if h.volume != nil {
+		if idx := sliceBits64(x, 63, 64-h.p); h.volume[idx] < math.MaxUint16 {
+			h.volume[idx]++
+		}
+	}
+
+	if h.sparse {
+		h.tmpSet = append(h.tmpSet, h.encodeHash(x))
+
+		// is tmpSet >= 1/4 of memory limit?
+		if 4*uint32(len(h.tmpSet))*8 >= 6*h.m/4 ||
+			h.autoFlushEvery > 0 && len(h.tmpSet) >= h.autoFlushEvery {
+			h.flushTmpSet()
+		}
+	} else {
+		idx := uint32(sliceBits64(x, 63, 64-h.p))
+		rho := rho(x<<h.p | 1<<(h.p-1))
+		h.updateRegisterIfBigger(idx, rho)
+	}
+
+	if h.maxBytes > 0 {
+		h.enforceMaxBytes()
+	}
+}
+
+// enforceMaxBytes converts h to dense and folds it to a lower precision as
+// needed to keep it within maxBytes.
+func (h *HLLPP) enforceMaxBytes() {
+	if h.sparse {
+		if len(h.data)+4*len(h.tmpSet) <= h.maxBytes {
+			return
+		}
+
+		// Stay sparse if flushing leaves a reasonable amount of room for
+		// tmpSet, otherwise we would be flushing on every Add.
+		h.flushTmpSet()
+		if h.sparse && 4*len(h.data) <= 3*h.maxBytes {
+			return
+		}
+
+		h.toNormal()
+	}
+
+	for len(h.data) > h.maxBytes && h.p > 4 {
+		h.fold(h.p - 1)
+	}
+}
+
+func (h *HLLPP) updateRegisterIfBigger(idx uint32, rho uint8) {
+	if rho > 31 && h.bitsPerRegister == 5 {
+		h.bitsPerRegister = 6
+		newData := make([]byte, h.m*h.bitsPerRegister/8)
+		for i := uint32(0); i < h.m; i++ {
+			setRegister(newData, 6, i, getRegister(h.data, 5, i))
+		}
+		h.data = newData
+	}
+
+	if old := getRegister(h.data, h.bitsPerRegister, idx); rho > old {
+		h.version++
+		setRegister(h.data, h.bitsPerRegister, idx, rho)
+		if h.tags != nil {
+			h.tags[idx] = 0
+		}
+		if h.onRegisterUpdate != nil {
+			h.onRegisterUpdate(idx, old, rho)
+		}
+	}
+}
+
+// Count returns the current cardinality estimate for h. Count is clamped to
+// math.MaxInt64 if the registers imply more than that (see CountWithDetail),
+// so counts can be converted to int64 or added in pairs without overflowing.
+func (h *HLLPP) Count() uint64 {
+	if h.countVersion == h.version+1 {
+		return h.cachedCount
+	}
+
+	var count uint64
+	if h.banks == nil {
+		count = h.count()
+	} else {
+		sum := float64(h.count())
+		for _, bank := range h.banks {
+			sum += float64(bank.count())
+		}
+		count = clampEstimate(sum / float64(len(h.banks)+1))
+	}
+
+	h.cachedCount, h.countVersion = count, h.version+1
+	return count
+}
+
+// CountDetail is the result of CountWithDetail.
+type CountDetail struct {
+	// Count is the same as the return value of Count.
+	Count uint64
+
+	// Clamped is true if Count was clamped to math.MaxInt64 because the
+	// registers implied an impossibly large cardinality.
+	Clamped bool
+}
+
+// CountWithDetail is like Count, but also reports whether the estimate had to
+// be clamped.
+func (h *HLLPP) CountWithDetail() CountDetail {
+	count := h.Count()
+	return CountDetail{
+		Count:   count,
+		Clamped: count == maxEstimate,
+	}
+}
+
+func (h *HLLPP) count() uint64 {
+	if h.sparse {
+		h.flushTmpSet()
+		if !h.rawEstimateOnly {
+			return h.linearCounting(h.mp, h.mp-h.sparseLength)
+		}
+	}
+
+	return h.estimate(h.registerSum())
+}
+
+// CountNoAlloc returns the same estimate as Count, but never allocates. Unlike
+// Count, it does not flush values buffered in sparse mode, which makes it
+// slower than Count for sparse estimators with many buffered values.
+func (h *HLLPP) CountNoAlloc() uint64 {
+	if !h.sparse {
+		return h.Count()
+	}
+
+	length, sum, numZeros := h.pendingSparse()
+	if h.rawEstimateOnly {
+		return h.estimate(sum, numZeros)
+	}
+	return h.linearCounting(h.mp, h.mp-length)
+}
+
+// CountPending returns the same estimate as Count, taking values buffered in
+// sparse mode into account without merging them into the sparse data (so
+// repeated calls never change h's contents). It is the same as CountNoAlloc.
+func (h *HLLPP) CountPending() uint64 {
+	return h.CountNoAlloc()
+}
+
+// LinearCount returns the linear counting estimate for h regardless of which
+// estimate Count would use. In sparse mode this is what Count returns (based
+// on m' and the number of sparse entries), and in dense mode it is based on m
+// and the number of zero registers. If no registers are zero, linear counting
+// is undefined and LinearCount returns math.MaxUint64. LinearCount doesn't
+// flush buffered values.
+func (h *HLLPP) LinearCount() uint64 {
+	if h.sparse {
+		length, _, _ := h.pendingSparse()
+		return h.linearCounting(h.mp, h.mp-length)
+	}
+
+	_, numZeros := h.registerSum()
+	if numZeros == 0 {
+		return math.MaxUint64
+	}
+	return h.linearCounting(h.m, numZeros)
+}
+
+// ExceedsThreshold reports whether Count() > n. It gives the same answer as
+// comparing Count() to n, but is cheaper when the count is well below n. In
+// dense mode it stops scanning registers as soon as the partial register sum
+// shows the estimate can't exceed n. In sparse mode no scan is needed if the
+// number of sparse entries (a lower bound for the count) already exceeds n.
+func (h *HLLPP) ExceedsThreshold(n uint64) bool {
+	if h.banks != nil {
+		return h.Count() > n
+	}
+
+	if h.sparse {
+		h.flushTmpSet()
+	}
+
+	if h.sparse {
+		if uint64(h.sparseLength) > n {
+			return true
+		}
+		if !h.rawEstimateOnly {
+			return h.linearCounting(h.mp, h.mp-h.sparseLength) > n
+		}
+		return h.Count() > n
+	}
+
+	// Linear counting is only used when it is below threshold, so if n is at
+	// least threshold, Count can only exceed n via the raw estimate (which
+	// only shrinks as more registers are added to the sum), adjusted by at
+	// most the biggest negative bias.
+	if !h.rawEstimateOnly && n < h.linearCountingThreshold() {
+		return h.Count() > n
+	}
+
+	var slack float64
+	if !h.rawEstimateOnly {
+		for _, bias := range biasData[h.p-4] {
+			if -bias > slack {
+				slack = -bias
+			}
+		}
+	}
+
+	numerator := alpha(h.m) * float64(h.m) * float64(h.m)
+
+	var (
+		sum      float64
+		numZeros uint32
+	)
+	for i := uint32(0); i < h.m; i++ {
+		reg := getRegister(h.data, h.bitsPerRegister, i)
+		sum += 1.0 / float64(uint64(1)<<reg)
+		if reg == 0 {
+			numZeros++
+		}
+
+		if numerator/sum+slack <= float64(n) {
+			return false
+		}
+	}
+
+	return h.estimate(sum, numZeros) > n
+}
+
+// RelativeError returns the standard error of h's estimate in the dense regime,
+// 1.04/sqrt(m) (counting the registers of all banks).
+func (h *HLLPP) RelativeError() float64 {
+	return 1.04 / math.Sqrt(float64(h.m)*float64(len(h.banks)+1))
+}
+
+// EstimatedRelativeError returns the expected relative error of Count given
+// which estimate Count currently uses:
+//
+//   - Linear counting (sparse mode, or dense mode with many empty registers):
+//     sqrt(m*(e^t - t - 1))/n where t = n/m, using m' in sparse mode. This is
+//     much smaller than the dense error for small cardinalities.
+//   - Otherwise: 1.04/sqrt(m), but counting only registers that haven't
+//     reached the biggest possible value. A saturated register only gives a
+//     lower bound, so the error widens as registers saturate (which only
+//     happens at cardinalities approaching 2^64).
+//
+// With banks, the error is divided by the square root of the number of banks.
+func (h *HLLPP) EstimatedRelativeError() float64 {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+
+	banks := math.Sqrt(float64(len(h.banks) + 1))
+
+	if h.sparse && !h.rawEstimateOnly {
+		return linearCountingError(h.mp, count) / banks
+	}
+
+	var numZeros, numSaturated uint32
+	if h.sparse {
+		_, numZeros = h.registerSum()
+	} else {
+		maxRho := 64 - h.p + 1
+		for i := uint32(0); i < h.m; i++ {
+			switch getRegister(h.data, h.bitsPerRegister, i) {
+			case 0:
+				numZeros++
+			case maxRho:
+				numSaturated++
+			}
+		}
+	}
+
+	if !h.rawEstimateOnly && numZeros > 0 && h.linearCounting(h.m, numZeros) < h.linearCountingThreshold() {
+		return linearCountingError(h.m, count) / banks
+	}
+
+	if numSaturated == h.m {
+		return math.Inf(1)
+	}
+	return 1.04 / math.Sqrt(float64(h.m-numSaturated)) / banks
+}
+
+// linearCountingError returns the standard error of linear counting with m
+// buckets for cardinality n (Whang et al.).
+func linearCountingError(m uint32, n uint64) float64 {
+	t := float64(n) / float64(m)
+	return math.Sqrt(float64(m)*(math.Exp(t)-t-1)) / float64(n)
+}
+
+// AbsoluteError returns the expected absolute error of Count in number of
+// values, i.e. RelativeError()*Count(). Since RelativeError is the error in
+// the dense regime, this is a conservative bound for small cardinalities,
+// where linear counting (or the sparse representation) is more accurate.
+func (h *HLLPP) AbsoluteError() uint64 {
+	return uint64(h.RelativeError()*float64(h.Count()) + 0.5)
+}
+
+// Health compares Count to the actual cardinality (e.g. from an exact count
+// done elsewhere), returning the relative error |Count-actual|/actual and
+// whether it is within tolerance. If actual is 0, the relative error is 0 if
+// Count is also 0, and +Inf otherwise.
+func (h *HLLPP) Health(actual uint64, tolerance float64) (withinTolerance bool, relErr float64) {
+	count := h.Count()
+
+	switch {
+	case actual > 0:
+		relErr = math.Abs(float64(count)-float64(actual)) / float64(actual)
+	case count > 0:
+		relErr = math.Inf(1)
+	}
+
+	return relErr <= tolerance, relErr
+}
+
+// SignificantlyDifferent reports whether the counts of h and other differ by
+// more than z standard errors, e.g. z=1.96 for 95% confidence. Each count's
+// standard error is EstimatedRelativeError()*Count(), and the error of the
+// difference is sqrt(se_h^2 + se_other^2). h and other must have the same p
+// and p' values.
+func (h *HLLPP) SignificantlyDifferent(other *HLLPP, z float64) (bool, error) {
+	if err := h.Validate(); err != nil {
+		return false, err
+	}
+
+	if err := other.Validate(); err != nil {
+		return false, fmt.Errorf("other: %s", err)
+	}
+
+	if h.p != other.p || h.pp != other.pp {
+		return false, errors.New("HLLPPs have different parameters")
+	}
+
+	hCount, otherCount := float64(h.Count()), float64(other.Count())
+	hErr := h.EstimatedRelativeError() * hCount
+	otherErr := other.EstimatedRelativeError() * otherCount
+
+	diff := math.Abs(hCount - otherCount)
+	return diff > z*math.Sqrt(hErr*hErr+otherErr*otherErr), nil
+}
+
+// FillRatio returns the fraction of h's m registers that are non-zero. For
+// cardinality n this should be about 1 - e^(-n/m), so comparing the two can
+// detect a poor hash function or corrupted data. In sparse mode the registers
+// are derived from the sparse data.
+func (h *HLLPP) FillRatio() float64 {
+	_, numZeros := h.registerSum()
+	return float64(h.m-numZeros) / float64(h.m)
+}
+
+// Coverage returns the fraction of a universe of universeSize distinct values
+// that h has seen, i.e. Count()/universeSize clamped to [0, 1]. It returns 0
+// if universeSize is 0.
+func (h *HLLPP) Coverage(universeSize uint64) float64 {
+	if universeSize == 0 {
+		return 0
+	}
+	return math.Min(1, float64(h.Count())/float64(universeSize))
+}
+
+// SaturatedRegisters returns how many of h's dense registers hold max, the
+// biggest possible register value of 65-p (every hash bit after the index
+// was zero). Such a register only gives a lower bound, so if more than a
+// small fraction of m are saturated, h is near the limit of what it can
+// estimate (see EstimatedRelativeError). Sparse estimators have no
+// registers, and return 0 for both.
+func (h *HLLPP) SaturatedRegisters() (count uint32, max uint8) {
+	if h.sparse {
+		return 0, 0
+	}
+
+	max = 64 - h.p + 1
+	for i := uint32(0); i < h.m; i++ {
+		if getRegister(h.data, h.bitsPerRegister, i) == max {
+			count++
+		}
+	}
+	return count, max
+}
+
+// estimate computes the dense estimate given the register sum and the number
+// of zero registers (see registerSum).
+func (h *HLLPP) estimate(est float64, numZeros uint32) uint64 {
+	if h.rawEstimateOnly {
+		return clampEstimate(alpha(h.m) * float64(h.m) * float64(h.m) / est)
+	}
+
+	if numZeros > 0 {
+		lc := h.linearCounting(h.m, numZeros)
+		if lc < h.linearCountingThreshold() {
+			return lc
+		}
+	}
+
+	est = alpha(h.m) * float64(h.m) * float64(h.m) / est
+
+	if est <= float64(h.m*5) {
+		est -= h.estimateBias(est)
+	}
+
+	return clampEstimate(est)
+}
+
+// linearCountingThreshold returns the estimate below which the dense estimate
+// uses linear counting.
+func (h *HLLPP) linearCountingThreshold() uint64 {
+	if h.linearCountingMaxFactor > 0 {
+		return uint64(h.linearCountingMaxFactor * float64(h.m))
+	}
+	return threshold[h.p-4]
+}
+
+// maxEstimate is the biggest estimate Count returns. A bigger one would mean
+// more than half of the 2^64 possible hashes were added, which real data can't
+// do, though the estimate of (for example) a dense estimator with every
+// register saturated is bigger still.
+const maxEstimate = math.MaxInt64
+
+// clampEstimate rounds est, clamping it to maxEstimate.
+func clampEstimate(est float64) uint64 {
+	if est+0.5 >= maxEstimate {
+		return maxEstimate
+	}
+	return uint64(est + 0.5)
+}
+
+// Validate checks that h's internal state is consistent, e.g. for an HLLPP
+// that wasn't created via New, NewWithConfig or Unmarshal (such as the zero
+// value). Most methods assume a valid HLLPP, and will panic or return garbage
+// otherwise. Merge validates both estimators.
+func (h *HLLPP) Validate() error {
+	if h.p < 4 || h.p > 16 || h.pp < h.p || h.pp > 25 {
+		return fmt.Errorf("invalid precision (p: %d, p': %d)", h.p, h.pp)
+	}
+
+	if h.m != 1<<h.p || h.mp != 1<<h.pp {
+		return fmt.Errorf("m (%d) and m' (%d) don't match p and p'", h.m, h.mp)
+	}
+
+	if h.sparse {
+		if h.bitsPerRegister != 0 {
+			return fmt.Errorf("sparse with %d bits per register", h.bitsPerRegister)
+		}
+		if h.sparseTooBig() {
+			return fmt.Errorf("sparse data (%d bytes) should have been converted to dense; see NormalizeRepresentation", len(h.data))
+		}
+	} else {
+		if h.bitsPerRegister != 5 && h.bitsPerRegister != 6 {
+			return fmt.Errorf("dense with %d bits per register", h.bitsPerRegister)
+		}
+		if uint32(len(h.data)) != h.m*h.bitsPerRegister/8 {
+			return fmt.Errorf("dense data has wrong length: %d", len(h.data))
+		}
+
+		// a register saturates at 65-p, when every hash bit after the
+		// index is zero
+		max := 64 - h.p + 1
+		for i := uint32(0); i < h.m; i++ {
+			if reg := getRegister(h.data, h.bitsPerRegister, i); reg > max {
+				return fmt.Errorf("register %d is %d, above the maximum of %d", i, reg, max)
+			}
+		}
+	}
+
+	if h.tags != nil && uint32(len(h.tags)) != h.m {
+		return fmt.Errorf("wrong number of tags: %d", len(h.tags))
+	}
+
+	if h.volume != nil && uint32(len(h.volume)) != h.m {
+		return fmt.Errorf("wrong number of volume counters: %d", len(h.volume))
+	}
+
+	if len(h.minHash) > h.minHashK {
+		return fmt.Errorf("too many MinHash values: %d", len(h.minHash))
+	}
+
+	for _, bank := range h.banks {
+		if err := bank.Validate(); err != nil {
+			return fmt.Errorf("bank: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// NormalizeRepresentation converts h to dense if it is sparse but its sparse
+// data is bigger than dense data would be, which Validate reports as an
+// error. Such an estimator can come from old or corrupt marshaled data, and
+// Unmarshal calls this automatically. No values are lost, so the count only
+// changes as much as switching from the sparse to the dense estimate does.
+func (h *HLLPP) NormalizeRepresentation() {
+	h.flushTmpSet()
+	if h.sparse && h.sparseTooBig() {
+		h.toNormal()
+	}
+}
+
+// Merge turns h into the union of h and other. h and other must have the same
+// p and p' values, unless h was created with Config.DowngradeOnMerge, in
+// which case other may have a lower p than h.
+//
+// If h is sparse and other is dense, h is only converted to dense if more
+// than 1/16 of other's registers are set; otherwise other's registers are
+// merged into h as sparse values.
+func (h *HLLPP) Merge(other *HLLPP) error {
+	return h.merge(other, func() error {
+		return h.mergeRegisters(other)
+	})
+}
+
+// merge does the bookkeeping Merge and MergeTagged share around
+// mergeRegisters, which merges other's registers into h: both estimators are
+// validated first, and afterwards other's volume counters and MinHash are
+// merged, and Config.MaxBytes and Config.AssertMonotonic are enforced.
+func (h *HLLPP) merge(other *HLLPP, mergeRegisters func() error) error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+
+	if err := other.Validate(); err != nil {
+		return fmt.Errorf("other: %s", err)
+	}
+
+	h.version++
+
+	if err := mergeRegisters(); err != nil {
+		return err
+	}
+
+	if h.volume != nil && other.volume != nil {
+		for i, v := range other.volume {
+			h.volume[i] = addVolume(h.volume[i], v)
+		}
+	}
+
+	if h.minHashK > 0 {
+		h.mergeMinHashFrom(other)
+	}
+
+	if h.maxBytes > 0 {
+		h.enforceMaxBytes()
+	}
+
+	if h.assertMonotonic {
+		h.checkMonotonic()
+	}
+
+	return nil
+}
+
+// mergeRegisters merges other's registers (and banks) into h for Merge.
+func (h *HLLPP) mergeRegisters(other *HLLPP) error {
+	if h.p > other.p && h.pp == other.pp {
+		if !h.downgradeOnMerge {
+			return fmt.Errorf("can't merge p=%d HLLPP into p=%d HLLPP: precision can only be lowered (see Config.DowngradeOnMerge)", other.p, h.p)
+		}
+		if len(h.banks) == len(other.banks) {
+			h.fold(other.p)
+		}
+	}
+
+	if h.p != other.p || h.pp != other.pp || len(h.banks) != len(other.banks) {
+		return errors.New("HLLPPs have different parameters")
+	}
+
+	for i, bank := range h.banks {
+		if err := bank.Merge(other.banks[i]); err != nil {
+			return err
+		}
+	}
+
+	// flush first, since flushing can convert to dense, and converting h to
+	// dense below would otherwise lose its tmpSet
+	if h.sparse {
+		h.flushTmpSet()
+	}
+
+	if other.sparse {
+		other.flushTmpSet()
+	}
+
+	// if h is empty, there is nothing to merge other into, so just copy its
+	// representation (unless hooks need to see each update)
+	adopt := h.sparse && len(h.data) == 0 && len(h.tmpSet) == 0 &&
+		h.onRegisterUpdate == nil && h.onSparseUpdate == nil
+
+	var fromDense []uint32
+	if !adopt && h.sparse && !other.sparse {
+		fromDense = h.sparseFromDense(other)
+		if fromDense == nil {
+			h.toNormal()
+		}
+	}
+
+	if adopt {
+		h.sparse = other.sparse
+		h.data = append([]byte(nil), other.data...)
+		h.sparseLength = other.sparseLength
+		h.bitsPerRegister = other.bitsPerRegister
+	} else if fromDense != nil {
+		h.mergeSparse(fromDense)
+	} else if h.sparse && other.sparse {
+		h.mergeSparseStream(other.data)
+	} else if !h.sparse && !other.sparse {
+		for i := uint32(0); i < h.m; i++ {
+			rho := getRegister(other.data, other.bitsPerRegister, i)
+			h.updateRegisterIfBigger(i, rho)
+		}
+	} else {
+		reader := newSparseReader(other.data)
+		for !reader.Done() {
+			idx, rho := other.decodeHash(reader.Next(), other.p)
+			h.updateRegisterIfBigger(idx, rho)
+		}
+	}
+
+	return nil
+}
+
+// MergeCapped is like Merge, but keeps h's data within maxBytes the way
+// Config.MaxBytes does: if the merged data doesn't fit, h is converted to
+// dense and permanently folded down to the biggest p that fits, which is
+// lossy. other may have a higher p than h (e.g. if h was folded by an earlier
+// MergeCapped), in which case a copy of other is folded to h's p before
+// merging; other isn't modified. maxBytes must be at least 12 (enough for
+// p=4), and h can't use banks.
+func (h *HLLPP) MergeCapped(other *HLLPP, maxBytes int) error {
+	if maxBytes < 12 {
+		return fmt.Errorf("invalid max bytes: %d", maxBytes)
+	}
+
+	if h.banks != nil {
+		return errors.New("MergeCapped does not support banks")
+	}
+
+	if other.p > h.p && other.pp == h.pp && other.banks == nil {
+		other = other.clone()
+		other.fold(h.p)
+	}
+
+	if err := h.Merge(other); err != nil {
+		return err
+	}
+
+	saved := h.maxBytes
+	h.maxBytes = maxBytes
+	h.enforceMaxBytes()
+	h.maxBytes = saved
+
+	return nil
+}
+
+// MergeFold turns h into the union of h and other like Merge, but allows
+// them to have different p values: the result has the lower of the two,
+// folding h down permanently if need be (see Config.DowngradeOnMerge), or
+// merging a folded copy of other if other has the higher p. Folding combines
+// groups of registers, so the result's expected error is that of the lower
+// p, i.e. it grows by a factor of sqrt(2) for each step p is lowered. h and
+// other must still have the same p' value.
+func (h *HLLPP) MergeFold(other *HLLPP) error {
+	if h.pp != other.pp {
+		return fmt.Errorf("can't merge p'=%d HLLPP into p'=%d HLLPP", other.pp, h.pp)
+	}
+
+	// check everything Merge would before folding h, which can't be undone
+	if len(h.banks) != len(other.banks) {
+		return errors.New("HLLPPs have different parameters")
+	}
+
+	if err := h.Validate(); err != nil {
+		return err
+	}
+
+	if err := other.Validate(); err != nil {
+		return fmt.Errorf("other: %s", err)
+	}
+
+	if other.p > h.p {
+		other = other.clone()
+		other.fold(h.p)
+	} else if h.p > other.p {
+		h.fold(other.p)
+	}
+
+	return h.Merge(other)
+}
+
+// MergeChanged is like Merge, but also reports whether h changed, i.e.
+// whether other had any values h didn't already account for (any register
+// increased, or any sparse index was added or increased). Merging a subset of
+// h's values reports no change. Converting to the dense representation alone
+// is not a change, but lowering h's precision is (see
+// Config.DowngradeOnMerge and Config.MaxBytes).
+func (h *HLLPP) MergeChanged(other *HLLPP) (changed bool, err error) {
+	// flush our own buffered values first so they don't count as changes
+	if h.sparse {
+		h.flushTmpSet()
+	}
+
+	p := h.p
+	for _, x := range append([]*HLLPP{h}, h.banks...) {
+		onRegisterUpdate, onSparseUpdate := x.onRegisterUpdate, x.onSparseUpdate
+		defer func(x *HLLPP) {
+			x.onRegisterUpdate, x.onSparseUpdate = onRegisterUpdate, onSparseUpdate
+		}(x)
+
+		x.onRegisterUpdate = func(index uint32, old, new uint8) {
+			changed = true
+			if onRegisterUpdate != nil {
+				onRegisterUpdate(index, old, new)
+			}
+		}
+		x.onSparseUpdate = func(index uint32, old, new uint8) {
+			changed = true
+			if onSparseUpdate != nil {
+				onSparseUpdate(index, old, new)
+			}
+		}
+	}
+
+	if err := h.Merge(other); err != nil {
+		return false, err
+	}
+
+	return changed || h.p != p, nil
+}
+
+// MergeWithOverlap is like Merge, but also returns the overlap between h and
+// other implied by the counts via inclusion-exclusion: Count of h before the
+// merge plus other's Count minus Count of h after, clamped to 0. Like
+// CountExcluding, this is the difference of estimates, so it is only
+// meaningful when the overlap isn't small compared to the union.
+func (h *HLLPP) MergeWithOverlap(other *HLLPP) (overlapEstimate uint64, err error) {
+	before, otherCount := h.Count(), other.Count()
+
+	if err := h.Merge(other); err != nil {
+		return 0, err
+	}
+
+	if after := h.Count(); before+otherCount > after {
+		return before + otherCount - after, nil
+	}
+	return 0, nil
 }
 
-// Approximate size in bytes of h (used for testing).
-func (h *HLLPP) memSize() int {
-	return cap(h.data) + 4*cap(h.tmpSet) + 20
+// MergeWithModeChange is like Merge, but also reports whether h converted
+// from the sparse to the dense representation during the merge, e.g. so
+// memory accounting can be updated.
+func (h *HLLPP) MergeWithModeChange(other *HLLPP) (modeChanged bool, err error) {
+	wasSparse := h.sparse
+
+	if err := h.Merge(other); err != nil {
+		return false, err
+	}
+
+	return wasSparse && !h.sparse, nil
 }
 
-// New creates a HyperLogLog++ estimator with p=14, p'=20.
-func New() *HLLPP {
-	h, err := NewWithConfig(Config{})
-	if err != nil {
-		panic(err)
+// sparseFromDense returns sparse values (sorted by index) for the registers of
+// the dense other that are bigger than the corresponding register of the
+// sparse h, so a mostly empty dense estimator (e.g. one created with
+// Config.StartDense) can be merged without converting h to dense. Each such
+// register becomes one sparse value with the register's index and rho, and
+// the rest of its p' index zero. Values in both h and other don't
+// contribute, since they can't make other's register bigger than h's. It
+// returns nil if at least 1/16 of other's registers are non-zero, in which
+// case h might as well be dense.
+func (h *HLLPP) sparseFromDense(other *HLLPP) []uint32 {
+	numSet, ok := other.mostlyEmptyDense()
+	if !ok {
+		return nil
 	}
-	return h
+
+	tmpSet := make([]uint32, 0, numSet)
+	reader := sparseReader{data: h.data}
+	for i := uint32(0); i < other.m; i++ {
+		rho := getRegister(other.data, other.bitsPerRegister, i)
+
+		// h's entries for register i are next, since they are sorted
+		var hRho uint8
+		for !reader.Done() && h.getIndex(reader.Peek(), h.p) == i {
+			if _, r := h.decodeHash(reader.Next(), h.p); r > hRho {
+				hRho = r
+			}
+		}
+
+		if rho <= hRho {
+			continue
+		}
+
+		tmpSet = append(tmpSet, h.encodeHash(h.registerHash(i, rho)))
+	}
+
+	return tmpSet
 }
 
-// Config is used to set configurable fields on a HyperLogLog++ via
-// NewWithConfig.
-type Config struct {
-	// Precision (p). Must be in the range [4..16]. This value can be used
-	// to adjust the typical relative error of the estimate. Space requirements
-	// grow exponentially as this value is increased. Defaults to 14, the
-	// recommended value, which gives an expected error of about 0.8%
-	Precision uint8
+// mostlyEmptyDense returns the number of h's non-zero dense registers, and
+// whether that is less than 1/16 of them, in which case merging h into a
+// sparse estimator keeps it sparse (see sparseFromDense).
+func (h *HLLPP) mostlyEmptyDense() (numSet uint32, ok bool) {
+	for i := uint32(0); i < h.m; i++ {
+		if getRegister(h.data, h.bitsPerRegister, i) > 0 {
+			numSet++
+		}
+	}
+	return numSet, numSet < h.m/16
+}
 
-	// Precision in sparse mode (p'). Must be in the range [p..25] for this
-	// implementation. This value can be used to adjust the typical relative
-	// error of the estimate when using the sparse representation (typically
-	// for cardinalities below 8000 at p'=20). Lowering p' will allow the
-	// estimator to remain in sparse mode longer, but will increase the relative
-	// error. The HyperLogLog++ paper recommends 20 or 25. Defaults to 20 since
-	// that still gives you a much lower error vs. p=14, but saves a significant
-	// amount of space vs. p'=25 (20-25% for cardinalities less than 5000).
-	SparsePrecision uint8
+// registerHash returns a hash with register index idx and rho-1 zeros after
+// it, i.e. one that would set register idx to rho.
+func (h *HLLPP) registerHash(idx uint32, rho uint8) uint64 {
+	x := uint64(idx) << (64 - h.p)
+	if rho <= 64-h.p {
+		x |= 1 << (64 - h.p - rho)
+	}
+	return x
 }
 
-// NewWithConfig creates a HyperLogLog++ estimator with the given Config.
-func NewWithConfig(c Config) (*HLLPP, error) {
-	if c.Precision == 0 {
-		c.Precision = 14
+// registerSum returns the sum of 2^-register over all m registers, and the
+// number of registers that are zero. In sparse mode the registers are derived
+// from the sparse data and tmpSet.
+func (h *HLLPP) registerSum() (sum float64, numZeros uint32) {
+	if !h.sparse {
+		for i := uint32(0); i < h.m; i++ {
+			reg := getRegister(h.data, h.bitsPerRegister, i)
+			sum += 1.0 / float64(uint64(1)<<reg)
+			if reg == 0 {
+				numZeros++
+			}
+		}
+		return sum, numZeros
 	}
 
-	if c.SparsePrecision == 0 {
-		c.SparsePrecision = 20
+	_, sum, numZeros = h.pendingSparse()
+	return sum, numZeros
+}
+
+// Combine returns a new HLLPP that is the union of a and b, without modifying
+// either of them. a and b must have the same p and p' values.
+func Combine(a, b *HLLPP) (*HLLPP, error) {
+	if a.p != b.p || a.pp != b.pp || len(a.banks) != len(b.banks) {
+		return nil, errors.New("HLLPPs have different parameters")
 	}
 
-	p, pp := c.Precision, c.SparsePrecision
-	if p < 4 || p > 16 || pp < p || pp > 25 {
-		return nil, fmt.Errorf("invalid precision (p: %d, p': %d)", p, pp)
+	// Merge flushes other's tmpSet, so don't let it touch b's
+	if len(b.tmpSet) > 0 {
+		b = b.clone()
 	}
 
-	return &HLLPP{
-		p:      p,
-		pp:     pp,
-		m:      1 << p,
-		mp:     1 << pp,
-		sparse: true,
-	}, nil
+	c := a.clone()
+	if err := c.Merge(b); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
-// Add will hash v and add the result to the HyperLogLog++ estimator h. hllpp
-// uses a built-in non-streaming implementation of murmur3.
-func (h *HLLPP) Add(v []byte) {
-	x := murmurSum64(v)
+// RollUp merges each group of estimators into a single new estimator per group
+// (e.g. to roll hourly estimators up into daily ones). Like Combine, it
+// doesn't modify the input estimators. All members of a group must have the
+// same p and p' values, and groups can't be empty.
+func RollUp(groups map[string][]*HLLPP) (map[string]*HLLPP, error) {
+	rolledUp := make(map[string]*HLLPP, len(groups))
+	for name, members := range groups {
+		if len(members) == 0 {
+			return nil, fmt.Errorf("group %q is empty", name)
+		}
 
-	if h.sparse {
-		h.tmpSet = append(h.tmpSet, h.encodeHash(x))
+		for _, member := range members[1:] {
+			if member.p != members[0].p || member.pp != members[0].pp || len(member.banks) != len(members[0].banks) {
+				return nil, fmt.Errorf("group %q: HLLPPs have different parameters", name)
+			}
+		}
 
-		// is tmpSet >= 1/4 of memory limit?
-		if 4*uint32(len(h.tmpSet))*8 >= 6*h.m/4 {
-			h.flushTmpSet()
+		h := members[0].clone()
+		for _, member := range members[1:] {
+			// Merge flushes other's tmpSet, so don't let it touch member's
+			if len(member.tmpSet) > 0 {
+				member = member.clone()
+			}
+
+			if err := h.Merge(member); err != nil {
+				return nil, fmt.Errorf("group %q: %s", name, err)
+			}
 		}
-	} else {
-		idx := uint32(sliceBits64(x, 63, 64-h.p))
-		rho := rho(x<<h.p | 1<<(h.p-1))
-		h.updateRegisterIfBigger(idx, rho)
+		rolledUp[name] = h
 	}
+
+	return rolledUp, nil
 }
 
-func (h *HLLPP) updateRegisterIfBigger(idx uint32, rho uint8) {
-	if rho > 31 && h.bitsPerRegister == 5 {
-		h.bitsPerRegister = 6
-		newData := make([]byte, h.m*h.bitsPerRegister/8)
-		for i := uint32(0); i < h.m; i++ {
-			setRegister(newData, 6, i, getRegister(h.data, 5, i))
-		}
-		h.data = newData
+// ExpectedUnionCount returns the expected size of the union of independent,
+// uniformly random subsets of a universe of universeSize values, where the
+// subsets have the given cardinalities. Each value is missing from every subset
+// with probability prod(1 - c/universeSize), so the expectation is
+// universeSize * (1 - prod(1 - c/universeSize)). This is useful for checking
+// whether the count of merged estimators is plausible. Cardinalities bigger
+// than universeSize are treated as universeSize.
+func ExpectedUnionCount(cardinalities []uint64, universeSize uint64) uint64 {
+	if universeSize == 0 {
+		return 0
 	}
 
-	if rho > getRegister(h.data, h.bitsPerRegister, idx) {
-		setRegister(h.data, h.bitsPerRegister, idx, rho)
+	n := float64(universeSize)
+	missing := 1.0
+	for _, c := range cardinalities {
+		if c >= universeSize {
+			return universeSize
+		}
+		missing *= 1 - float64(c)/n
 	}
+
+	return uint64(n*(1-missing) + 0.5)
 }
 
-// Count returns the current cardinality estimate for h.
-func (h *HLLPP) Count() uint64 {
-	if h.sparse {
-		h.flushTmpSet()
-		return linearCounting(h.mp, h.mp-h.sparseLength)
+// WeightedAverageCount returns the average of the sketches' counts, weighted
+// by weights. This blends independent estimates of the same quantity (e.g.
+// from sources of varying reliability); it is not a union, for which use
+// Merge. weights must be the same length as sketches, non-negative, and not
+// all 0.
+func WeightedAverageCount(sketches []*HLLPP, weights []float64) (float64, error) {
+	if len(sketches) != len(weights) {
+		return 0, fmt.Errorf("got %d sketches but %d weights", len(sketches), len(weights))
 	}
 
-	var (
-		est      float64
-		numZeros uint32
-	)
-	for i := uint32(0); i < h.m; i++ {
-		reg := getRegister(h.data, h.bitsPerRegister, i)
-		est += 1.0 / float64(uint64(1)<<reg)
-		if reg == 0 {
-			numZeros++
+	var sum, totalWeight float64
+	for i, h := range sketches {
+		if !(weights[i] >= 0) {
+			return 0, fmt.Errorf("invalid weight %d: %f", i, weights[i])
 		}
+		sum += weights[i] * float64(h.Count())
+		totalWeight += weights[i]
 	}
 
-	if numZeros > 0 {
-		lc := linearCounting(h.m, numZeros)
-		if lc < threshold[h.p-4] {
-			return lc
+	if totalWeight == 0 {
+		return 0, errors.New("weights sum to 0")
+	}
+
+	return sum / totalWeight, nil
+}
+
+// CountExcluding estimates how many distinct values were added to h but not
+// to background, without modifying either. It is computed via
+// inclusion-exclusion as Count(h ∪ background) - Count(background), clamped
+// to 0. Since it is the difference of two estimates, its absolute error is
+// roughly that of the union's estimate, so the relative error can be very
+// large when the difference is small compared to the union. h and background
+// must have the same p and p' values.
+func (h *HLLPP) CountExcluding(background *HLLPP) (uint64, error) {
+	union, err := Combine(h, background)
+	if err != nil {
+		return 0, err
+	}
+
+	unionCount, backgroundCount := union.Count(), background.Count()
+	if unionCount < backgroundCount {
+		return 0, nil
+	}
+	return unionCount - backgroundCount, nil
+}
+
+// SymmetricDifferenceCount estimates how many distinct values were added to
+// exactly one of h and other, without modifying either. It is computed as
+// Count(h ∪ other) minus the intersection, where the intersection is itself
+// estimated via inclusion-exclusion, and is clamped to 0. The same caveats
+// as CountExcluding apply: the absolute error is roughly that of the union's
+// estimate. h and other must have the same p and p' values.
+func (h *HLLPP) SymmetricDifferenceCount(other *HLLPP) (uint64, error) {
+	union, err := Combine(h, other)
+	if err != nil {
+		return 0, err
+	}
+
+	unionCount := float64(union.Count())
+	intersection := math.Max(0, float64(h.Count())+float64(other.Count())-unionCount)
+	return uint64(math.Max(0, unionCount-intersection)), nil
+}
+
+// RegisterDifferenceCount returns the number of registers that differ between
+// h and other, a cheap (but coarse) measure of how similar they are. Sparse
+// estimators are compared using dense copies of their registers, and aren't
+// converted. h and other must have the same p value.
+func (h *HLLPP) RegisterDifferenceCount(other *HLLPP) (uint32, error) {
+	if h.p != other.p {
+		return 0, errors.New("HLLPPs have different parameters")
+	}
+
+	hRegisters, otherRegisters := h.ExportDense8(), other.ExportDense8()
+
+	var count uint32
+	for i := range hRegisters {
+		if hRegisters[i] != otherRegisters[i] {
+			count++
 		}
 	}
+	return count, nil
+}
 
-	est = alpha(h.m) * float64(h.m) * float64(h.m) / est
+// Clone returns a deep copy of h, e.g. to take a snapshot while continuing to
+// add to h. Changes to either don't affect the other. The copy has the same
+// Config, including the update hooks (see Config.OnRegisterUpdate), which are
+// called for updates to either. Values buffered in sparse mode are copied
+// as-is, without flushing them.
+func (h *HLLPP) Clone() *HLLPP {
+	c := h.clone()
+	c.onRegisterUpdate, c.onSparseUpdate = h.onRegisterUpdate, h.onSparseUpdate
+	return c
+}
 
-	if est <= float64(h.m*5) {
-		est -= h.estimateBias(est)
+// clone returns a deep copy of h without the update hooks, since internal
+// copies are temporaries whose updates the hooks shouldn't see.
+func (h *HLLPP) clone() *HLLPP {
+	c := *h
+	c.onRegisterUpdate, c.onSparseUpdate = nil, nil
+	c.data = append([]byte(nil), h.data...)
+	c.tmpSet = append([]uint32(nil), h.tmpSet...)
+	if h.volume != nil {
+		c.volume = append([]uint16(nil), h.volume...)
+	}
+	if h.hashStats != nil {
+		stats := *h.hashStats
+		c.hashStats = &stats
+	}
+	if h.minHash != nil {
+		c.minHash = append([]uint64(nil), h.minHash...)
 	}
+	if h.tags != nil {
+		c.tags = append([]uint16(nil), h.tags...)
+	}
+	if h.banks != nil {
+		c.banks = make([]*HLLPP, len(h.banks))
+		for i, bank := range h.banks {
+			c.banks[i] = bank.clone()
+		}
+	}
+	return &c
+}
 
-	return uint64(est + 0.5)
+// MergeTagged is like Merge, but also records tag as the owner of every
+// register whose value is raised by other. This can be used to approximate
+// which of several merged sources contributed the distinct values in h (see
+// TagContribution). Registers later raised by Add or Merge become untagged.
+// MergeTagged always converts h to the dense representation. Tags must be
+// in the range [0..65534], and are not preserved by Marshal. Folding h (e.g.
+// to stay within Config.MaxBytes) drops the tags.
+func (h *HLLPP) MergeTagged(other *HLLPP, tag int) error {
+	if tag < 0 || tag >= math.MaxUint16 {
+		return fmt.Errorf("tag out of range: %d", tag)
+	}
+
+	return h.merge(other, func() error {
+		return h.mergeTaggedRegisters(other, tag)
+	})
 }
 
-// Merge turns h into the union of h and other. h and other must have the same
-// p and p' values.
-func (h *HLLPP) Merge(other *HLLPP) error {
+// mergeTaggedRegisters merges other's registers into h for MergeTagged.
+func (h *HLLPP) mergeTaggedRegisters(other *HLLPP, tag int) error {
 	if h.p != other.p || h.pp != other.pp {
 		return errors.New("HLLPPs have different parameters")
 	}
 
-	if h.sparse && !other.sparse {
+	if h.banks != nil || other.banks != nil {
+		return errors.New("MergeTagged does not support banks")
+	}
+
+	if h.sparse {
+		h.flushTmpSet()
 		h.toNormal()
 	}
 
+	if h.tags == nil {
+		h.tags = make([]uint16, h.m)
+	}
+
+	update := func(idx uint32, rho uint8) {
+		if rho > getRegister(h.data, h.bitsPerRegister, idx) {
+			h.updateRegisterIfBigger(idx, rho)
+			h.tags[idx] = uint16(tag + 1)
+		}
+	}
+
 	if other.sparse {
 		other.flushTmpSet()
 	}
 
-	if h.sparse && other.sparse {
-		tmpSet := make([]uint32, other.sparseLength)
+	if other.sparse {
 		reader := newSparseReader(other.data)
-		for index := 0; !reader.Done(); index++ {
-			tmpSet[index] = reader.Next()
-		}
-		h.mergeSparse(tmpSet)
-	} else if !h.sparse && !other.sparse {
-		for i := uint32(0); i < h.m; i++ {
-			rho := getRegister(other.data, other.bitsPerRegister, i)
-			h.updateRegisterIfBigger(i, rho)
+		for !reader.Done() {
+			update(other.decodeHash(reader.Next(), other.p))
 		}
 	} else {
-		reader := newSparseReader(other.data)
-		for !reader.Done() {
-			idx, rho := other.decodeHash(reader.Next(), other.p)
-			h.updateRegisterIfBigger(idx, rho)
+		for i := uint32(0); i < h.m; i++ {
+			update(i, getRegister(other.data, other.bitsPerRegister, i))
 		}
 	}
 
 	return nil
 }
 
+// TagContribution estimates how much of h's current count each tag passed
+// to MergeTagged is responsible for. Each tag's share of the count is
+// proportional to the number of non-zero registers it owns. Registers set
+// by untagged Add or Merge calls are not attributed to any tag, so the
+// shares only sum to Count if all data was merged via MergeTagged. This is
+// a rough approximation: overlapping sources are attributed to whichever
+// one set the register first.
+func (h *HLLPP) TagContribution() map[int]uint64 {
+	contrib := make(map[int]uint64)
+	if h.tags == nil {
+		return contrib
+	}
+
+	var (
+		numSet uint32
+		owned  = make(map[int]uint32)
+	)
+	for i := uint32(0); i < h.m; i++ {
+		if getRegister(h.data, h.bitsPerRegister, i) == 0 {
+			continue
+		}
+		numSet++
+		if h.tags[i] > 0 {
+			owned[int(h.tags[i])-1]++
+		}
+	}
+
+	count := h.Count()
+	for tag, n := range owned {
+		contrib[tag] = uint64(float64(count)*float64(n)/float64(numSet) + 0.5)
+	}
+
+	return contrib
+}
+
+// SeedCardinality quickly approximates adding n distinct values to h, for use
+// in tests and benchmarks. Instead of hashing values, each register is set to
+// a random value drawn from the distribution it would have after n distinct
+// values (a register is at most k with probability e^(-(n/m)*2^-k)). Existing
+// registers are kept if they are bigger. The result is only approximate, but
+// Count should be close to n (plus any values already in h). h is converted
+// to the dense representation. The random values are deterministic for a
+// given n, and differ between h and each of its banks.
+func SeedCardinality(h *HLLPP, n uint64) {
+	seedCardinality(h, n, int64(n))
+}
+
+func seedCardinality(h *HLLPP, n uint64, seed int64) {
+	if h.sparse {
+		h.flushTmpSet()
+		h.toNormal()
+	}
+
+	gen := rand.New(rand.NewSource(seed))
+	lambda := float64(n) / float64(h.m)
+	maxRho := 64 - h.p + 1
+
+	for i := uint32(0); i < h.m; i++ {
+		u := gen.Float64()
+
+		var k uint8
+		for k < maxRho && math.Exp(-lambda*math.Pow(2, -float64(k))) < u {
+			k++
+		}
+
+		if k > 0 {
+			h.updateRegisterIfBigger(i, k)
+		}
+	}
+
+	for i, bank := range h.banks {
+		seedCardinality(bank, n, seed+int64(i+1))
+	}
+}
+
+// Reset empties h so it can be reused instead of creating a new estimator,
+// keeping its Config (and current p, which may have been lowered by folding).
+// h goes back to the sparse representation, even if it was created with
+// Config.StartDense, and tmpSet's buffer is kept. Estimators with banks are
+// always dense, and are reset via ResetDense instead. Config.AssertMonotonic
+// treats the reset registers as a new starting point rather than a decrease.
+func (h *HLLPP) Reset() {
+	if h.banks != nil {
+		h.ResetDense()
+		return
+	}
+
+	h.resetState()
+	h.data = nil
+	h.sparse = true
+	h.sparseLength = 0
+	h.bitsPerRegister = 0
+}
+
+// ResetDense empties h, leaving it dense. If h is already dense, its
+// registers are zeroed in place, keeping the current bits per register, so a
+// dense estimator can be reused (e.g. across aggregation windows) without
+// allocating. A sparse h is converted to empty dense registers. Everything
+// else is cleared as by Reset.
+func (h *HLLPP) ResetDense() {
+	for _, bank := range h.banks {
+		bank.ResetDense()
+	}
+
+	h.resetState()
+
+	if h.sparse {
+		h.data = nil
+		h.sparseLength = 0
+		h.toNormal()
+		return
+	}
+
+	for i := range h.data {
+		h.data[i] = 0
+	}
+}
+
+// resetState clears everything Reset and ResetDense clear other than the
+// registers (or sparse data): buffered values, tags, volume counters, the
+// MinHash sketch and hash statistics. Since the registers go down, the next
+// CheckpointMarshal can't be a delta, and AssertMonotonic starts over.
+func (h *HLLPP) resetState() {
+	h.version++
+	h.tmpSet = h.tmpSet[:0]
+	h.tags = nil
+
+	for i := range h.volume {
+		h.volume[i] = 0
+	}
+	h.minHash = h.minHash[:0]
+
+	if h.hashStats != nil {
+		*h.hashStats = HashStats{}
+	}
+
+	h.checkpoint = nil
+	h.monotonicSum, h.monotonicP = 0, 0
+}
+
 func (h *HLLPP) toNormal() {
 	if !h.sparse {
 		return
@@ -231,10 +1949,158 @@ func (h *HLLPP) toNormal() {
 	h.data = newData
 	h.tmpSet = nil
 	h.sparse = false
+	h.version++
+}
+
+// Fold permanently lowers h's precision to newP, combining each group of
+// registers into one, e.g. for cheaper approximate counts from a copy of an
+// estimator kept at a higher precision. The result is the same as if the
+// values had been added to an estimator with p=newP (and the same p'), so its
+// expected error is that of newP. Tags are dropped (see MergeTagged). newP
+// must be in the range [4..p]; folding to the current p does nothing.
+func (h *HLLPP) Fold(newP uint8) error {
+	if newP < 4 || newP > h.p {
+		return fmt.Errorf("invalid target precision %d for p=%d", newP, h.p)
+	}
+
+	h.fold(newP)
+	return nil
+}
+
+// fold lowers h's precision to p (which must not be above h.p) by combining
+// registers. The top p bits of the old register index are the new index, and
+// the remaining bits of the old index are part of the new register's rho.
+// Tags are dropped.
+func (h *HLLPP) fold(p uint8) {
+	if p >= h.p {
+		return
+	}
+
+	for _, bank := range h.banks {
+		bank.fold(p)
+	}
+
+	h.version++
+	h.tags = nil
+
+	if h.sparse {
+		h.flushTmpSet()
+	}
+
+	oldP := h.p
+	h.p = p
+	h.m = 1 << p
+
+	if h.volume != nil {
+		volume := make([]uint16, h.m)
+		for i, v := range h.volume {
+			volume[i>>(oldP-p)] = addVolume(volume[i>>(oldP-p)], v)
+		}
+		h.volume = volume
+	}
+
+	if h.sparse {
+		// The p' index doesn't change, but values that stored rho' because
+		// bits oldP..p' were zero only need to do that if bits p..p' are zero.
+		writer := newSparseWriter()
+		reader := newSparseReader(h.data)
+		for !reader.Done() {
+			k := reader.Next()
+			if k&1 > 0 && sliceBits32(k, 6+h.pp-p, 7+h.pp-oldP) != 0 {
+				k = k >> 7 << 1
+			}
+			idx, rho := h.decodeHash(k, h.pp)
+			writer.Append(k, idx, rho)
+		}
+
+		h.data = writer.Bytes()
+		h.sparseLength = writer.Len()
+
+		if uint32(len(h.data))*8 >= 6*h.m {
+			h.toNormal()
+		}
+		return
+	}
+
+	// not an update of individual registers
+	onRegisterUpdate := h.onRegisterUpdate
+	h.onRegisterUpdate = nil
+	defer func() { h.onRegisterUpdate = onRegisterUpdate }()
+
+	d := oldP - p
+	oldData, oldBits := h.data, h.bitsPerRegister
+	h.bitsPerRegister = 5
+	h.data = make([]byte, h.m*h.bitsPerRegister/8)
+
+	for i := uint32(0); i < 1<<oldP; i++ {
+		r := getRegister(oldData, oldBits, i)
+		if r == 0 {
+			continue
+		}
+
+		// the dropped index bits become the leading bits of the hash
+		if dropped := uint64(i) & (1<<d - 1); dropped > 0 {
+			r = rho(dropped << (64 - d))
+		} else {
+			r += d
+		}
+		h.updateRegisterIfBigger(i>>d, r)
+	}
+}
+
+// VolumeEstimate returns the total number of values added to h (including
+// repeats), or 0 if h wasn't created with Config.TrackVolume. It is exact
+// unless some register saw more than 65535 values.
+func (h *HLLPP) VolumeEstimate() uint64 {
+	var sum uint64
+	for _, v := range h.volume {
+		sum += uint64(v)
+	}
+	return sum
+}
+
+// addVolume adds volume counters, saturating at math.MaxUint16.
+func addVolume(a, b uint16) uint16 {
+	if a > math.MaxUint16-b {
+		return math.MaxUint16
+	}
+	return a + b
 }
 
-func linearCounting(m, v uint32) uint64 {
-	return uint64(float64(m)*math.Log(float64(m)/float64(v)) + 0.5)
+// linearCounting returns the linear counting estimate for m registers with v
+// of them zero. The explicit float64 conversion prevents the compiler from
+// fusing the multiply and add, which some architectures would round
+// differently.
+func (h *HLLPP) linearCounting(m, v uint32) uint64 {
+	log := math.Log
+	if h.deterministicCount {
+		log = portableLog
+	}
+	return uint64(float64(float64(m)*log(float64(m)/float64(v))) + 0.5)
+}
+
+// portableLog returns the natural logarithm of x (which must be positive and
+// finite) using only basic float64 arithmetic, so the result is the same on
+// every architecture. math.Log is implemented in assembly on some
+// architectures, which can differ from the pure Go version in the last bit.
+func portableLog(x float64) float64 {
+	// x = f * 2^e with f in [sqrt(2)/2, sqrt(2))
+	f, e := math.Frexp(x)
+	if f < math.Sqrt2/2 {
+		f *= 2
+		e--
+	}
+
+	// log(f) = 2*atanh(s) = 2*(s + s^3/3 + s^5/5 + ...), where |s| < 0.18,
+	// evaluated from the smallest term up
+	s := float64((f - 1) / (f + 1))
+	s2 := float64(s * s)
+	var sum float64
+	for i := 39; i > 0; i -= 2 {
+		sum = float64(1/float64(i)) + float64(s2*sum)
+	}
+
+	return float64(float64(e)*math.Ln2) + float64(2*s*sum)
 }
 
 // slice out inclusive bit section [x.high..x.low]
@@ -248,9 +2114,6 @@ func sliceBits32(x uint32, high, low uint8) uint32 {
 }
 
 // number of leading zeros plus 1 (rho as in "ϱ" in paper)
-func rho(x uint64) (z uint8) {
-	for bit := uint64(1 << 63); bit&x == 0 && bit > 0; bit >>= 1 {
-		z++
-	}
-	return z + 1
+func rho(x uint64) uint8 {
+	return uint8(bits.LeadingZeros64(x)) + 1
 }
@@ -5,9 +5,13 @@ package hllpp
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"math"
+	"math/rand"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -102,6 +106,150 @@ func TestBiasCorrection(t *testing.T) {
 	}
 }
 
+func rawEstimate(h *HLLPP) uint64 {
+	var sum float64
+	for i := uint32(0); i < h.m; i++ {
+		sum += 1.0 / float64(uint64(1)<<getRegister(h.data, h.bitsPerRegister, i))
+	}
+	return uint64(alpha(h.m)*float64(h.m)*float64(h.m)/sum + 0.5)
+}
+
+func TestRawEstimateOnly(t *testing.T) {
+	h, err := NewWithConfig(Config{RawEstimateOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, count := range []uint64{100, 1000, 5000, 50000} {
+		// normal HLLPP to compare registers against
+		normal := New()
+
+		for i := uint64(0); i < count; i++ {
+			h.Add(intToBytes(i))
+			normal.Add(intToBytes(i))
+		}
+
+		if h.sparse != normal.sparse {
+			t.Fatalf("representations diverged at %d", count)
+		}
+
+		corrected := normal.Count()
+
+		normal.toNormal()
+		if got, exp := h.Count(), rawEstimate(normal); got != exp {
+			t.Errorf("count %d: got %d, expected raw estimate %d", count, got, exp)
+		}
+
+		// the corrections do actually change the estimate in these ranges
+		if corrected == h.Count() {
+			t.Errorf("count %d: raw estimate same as corrected estimate", count)
+		}
+	}
+}
+
+func TestCountNoAlloc(t *testing.T) {
+	for _, raw := range []bool{false, true} {
+		h, err := NewWithConfig(Config{RawEstimateOnly: raw})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		other, err := NewWithConfig(Config{RawEstimateOnly: raw})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, count := range []uint64{0, 10, 1000, 2345, 100000} {
+			for i := uint64(0); i < count; i++ {
+				h.Add(intToBytes(i))
+				other.Add(intToBytes(i))
+			}
+
+			allocs := testing.AllocsPerRun(10, func() {
+				h.CountNoAlloc()
+			})
+			if allocs != 0 {
+				t.Errorf("count %d (sparse: %v): got %f allocs", count, h.sparse, allocs)
+			}
+
+			// doesn't flush tmpSet
+			if count > 0 && h.sparse && len(h.tmpSet) == 0 {
+				t.Errorf("count %d: tmpSet was flushed", count)
+			}
+
+			if got, exp := h.CountNoAlloc(), other.Count(); got != exp {
+				t.Errorf("count %d (raw: %v): got %d, expected %d", count, raw, got, exp)
+			}
+		}
+	}
+}
+
+func TestBanks(t *testing.T) {
+	stdDev := func(banks int) float64 {
+		const (
+			trials = 200
+			count  = 2000
+		)
+
+		var sumSq float64
+		for trial := uint64(0); trial < trials; trial++ {
+			h, err := NewWithConfig(Config{Precision: 6, Banks: banks})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := uint64(0); i < count; i++ {
+				h.Add(intToBytes(trial<<32 | i))
+			}
+
+			e := (float64(h.Count()) - count) / count
+			sumSq += e * e
+		}
+		return math.Sqrt(sumSq / trials)
+	}
+
+	one, four := stdDev(1), stdDev(4)
+	if four > 0.75*one {
+		t.Errorf("expected less variance with 4 banks: %f vs %f", four, one)
+	}
+
+	h, err := NewWithConfig(Config{Precision: 6, Banks: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.sparse || len(h.banks) != 3 {
+		t.Errorf("expected 4 dense banks")
+	}
+
+	if err := h.Merge(New()); err == nil {
+		t.Error("expected error merging different number of banks")
+	}
+
+	for _, c := range []Config{{Banks: 3}, {Banks: 16}} {
+		if _, err := NewWithConfig(c); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+
+	// every bank sees the full hash, so big counts don't hit a ceiling
+	for _, c := range []Config{{Precision: 4, Banks: 8}, {Precision: 6, Banks: 4}, {Banks: 2}} {
+		h := MustNewWithConfig(c)
+		const n = 2000000
+		for i := uint64(0); i < n; i++ {
+			h.Add(intToBytes(i))
+		}
+
+		// within 3 standard errors of the averaged estimate
+		precision := c.Precision
+		if precision == 0 {
+			precision = 14
+		}
+		if e := estimateError(h.Count(), n); e > 3*1.04/math.Sqrt(float64(c.Banks<<precision)) {
+			t.Errorf("%+v: Got %d, expected %d (%f)", c, h.Count(), n, e)
+		}
+	}
+}
+
 func TestMerge(t *testing.T) {
 	h := New()
 	other := New()
@@ -211,6 +359,147 @@ func TestMerge(t *testing.T) {
 	}
 }
 
+func TestCombine(t *testing.T) {
+	gen := rand.New(rand.NewSource(1))
+
+	randomHLLPP := func() *HLLPP {
+		h := New()
+		start := gen.Uint64() % 100000
+		for i, n := uint64(0), gen.Uint64()%20000; i < n; i++ {
+			h.Add(intToBytes(start + i))
+		}
+		return h
+	}
+
+	mustCombine := func(a, b *HLLPP) *HLLPP {
+		c, err := Combine(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	for i := 0; i < 20; i++ {
+		a, b, c := randomHLLPP(), randomHLLPP(), randomHLLPP()
+		origA, origB := a.clone(), b.clone()
+
+		ab, ba := mustCombine(a, b), mustCombine(b, a)
+		if ab.Count() != ba.Count() {
+			t.Errorf("not commutative: %d vs %d", ab.Count(), ba.Count())
+		}
+
+		if !reflect.DeepEqual(a, origA) || !reflect.DeepEqual(b, origB) {
+			t.Fatal("Combine modified its arguments")
+		}
+
+		left, right := mustCombine(ab, c), mustCombine(a, mustCombine(b, c))
+		if left.Count() != right.Count() {
+			t.Errorf("not associative: %d vs %d", left.Count(), right.Count())
+		}
+	}
+
+	other, err := NewWithConfig(Config{Precision: 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Combine(New(), other); err == nil {
+		t.Error("Expecting error about mismatched parameters")
+	}
+}
+
+func TestMergeTagged(t *testing.T) {
+	h := New()
+
+	// three disjoint sources of the same size
+	for tag := 0; tag < 3; tag++ {
+		src := New()
+		for i := uint64(0); i < 20000; i++ {
+			src.Add(intToBytes(uint64(tag)<<32 | i))
+		}
+
+		if err := h.MergeTagged(src, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if e := estimateError(h.Count(), 60000); e > 0.02 {
+		t.Errorf("Got %d, expected %d (%f)", h.Count(), 60000, e)
+	}
+
+	// ties go to the first source to set a register, so this is rough
+	contrib := h.TagContribution()
+	if len(contrib) != 3 {
+		t.Fatalf("got %+v", contrib)
+	}
+
+	var total uint64
+	for tag, n := range contrib {
+		if e := estimateError(n, 20000); e > 0.25 {
+			t.Errorf("tag %d: got %d, expected ~%d (%f)", tag, n, 20000, e)
+		}
+		total += n
+	}
+
+	if e := estimateError(total, h.Count()); e > 0.001 {
+		t.Errorf("shares add up to %d, count is %d", total, h.Count())
+	}
+
+	// untagged adds take ownership away from tags
+	for i := uint64(0); i < 100000; i++ {
+		h.Add(intToBytes(3<<32 | i))
+	}
+
+	var after uint64
+	for _, n := range h.TagContribution() {
+		after += n
+	}
+	if after > h.Count()/2 {
+		t.Errorf("expected tagged share to shrink, got %d of %d", after, h.Count())
+	}
+
+	if err := h.MergeTagged(New(), -1); err == nil {
+		t.Error("expected error for negative tag")
+	}
+
+	// volume counters are merged like Merge does
+	vh, vother := MustNewWithConfig(Config{TrackVolume: true}), MustNewWithConfig(Config{TrackVolume: true})
+	vother.Add([]byte("foo"))
+	if err := vh.MergeTagged(vother, 0); err != nil {
+		t.Fatal(err)
+	}
+	var vol int
+	for _, v := range vh.volume {
+		vol += int(v)
+	}
+	if vol != 1 {
+		t.Errorf("got volume %d, expected 1", vol)
+	}
+
+	// and corrupt estimators are rejected
+	bad := vother.clone()
+	bad.volume = bad.volume[:1]
+	if err := vh.MergeTagged(bad, 0); err == nil {
+		t.Error("expected error merging corrupt estimator")
+	}
+
+	// and AssertMonotonic is checked
+	mh := MustNewWithConfig(Config{StartDense: true, AssertMonotonic: true})
+	for i := uint64(0); i < 10000; i++ {
+		mh.Add(intToBytes(i))
+	}
+	for i := uint32(0); i < 10; i++ {
+		setRegister(mh.data, mh.bitsPerRegister, i, 0)
+	}
+
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "registers decreased") {
+			t.Errorf("expected panic, got %v", r)
+		}
+	}()
+	mh.MergeTagged(New(), 0)
+	t.Error("expected panic")
+}
+
 func TestBitsPerRegister(t *testing.T) {
 	h := New()
 
@@ -253,6 +542,33 @@ func TestBitsPerRegister(t *testing.T) {
 	}
 }
 
+func TestMergeDenseKeepsPending(t *testing.T) {
+	h, dense, exp := New(), New(), New()
+	for i := uint64(0); i < 100; i++ {
+		h.Add(intToBytes(i))
+		exp.Add(intToBytes(i))
+	}
+	if !h.sparse || len(h.tmpSet) == 0 {
+		t.Fatal("expected pending sparse values")
+	}
+
+	for i := uint64(1000); i < 101000; i++ {
+		dense.Add(intToBytes(i))
+		exp.Add(intToBytes(i))
+	}
+
+	if err := h.Merge(dense); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.sparse || exp.sparse {
+		t.Fatal("expected dense")
+	}
+	if !bytes.Equal(h.data, exp.data) {
+		t.Error("merge lost h's pending sparse values")
+	}
+}
+
 func bitsToUint32(bits string) uint32 {
 	bits = strings.Replace(bits, " ", "", -1)
 	i, err := strconv.ParseUint(bits, 2, 32)
@@ -459,6 +775,66 @@ func TestEncodeDecodeHash(t *testing.T) {
 	}
 }
 
+func TestEncodeDecodeSparse(t *testing.T) {
+	cases := []struct {
+		pp      uint8
+		x       string
+		encoded string
+		index   string
+		rho     uint8
+	}{
+		{
+			25,
+			"11111111 00000000 11111111 00000000 11111111 11111111 11111111 11111111",
+			"11111111 00000000 11111111 0  0",
+			"11111111 000000",
+			3,
+		},
+		{
+			25,
+			"11111111 11111000 00000000 01111111 11111111 11111111 11111111 11111111",
+			"11111111 11111000 00000000 0 000001 1",
+			"11111111 111110",
+			12,
+		},
+		{
+			25,
+			"00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000",
+			"00000000 00000000 00000000 0 101000 1",
+			"00000000 000000",
+			51,
+		},
+		{
+			20,
+			"11111111 00000000 00000111 00000000 11111111 11111111 11111111 11111111",
+			"11111111 00000000 0000 000010 1",
+			"11111111 000000",
+			8,
+		},
+	}
+
+	for i, c := range cases {
+		h, err := NewWithConfig(Config{SparsePrecision: c.pp})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e := h.EncodeSparse(bitsToUint64(c.x))
+		if e != bitsToUint32(c.encoded) {
+			t.Errorf("#%d: got %s", i, uint32ToBits(e))
+		}
+
+		idx, r := h.DecodeSparse(e)
+		if idx != bitsToUint32(c.index) {
+			t.Errorf("#%d: got %s", i, uint32ToBits(idx))
+		}
+
+		if r != c.rho {
+			t.Errorf("#%d: got %d", i, r)
+		}
+	}
+}
+
 func TestSliceBits(t *testing.T) {
 	n := bitsToUint32("11111111 11111111 11111111 11111111")
 
@@ -493,6 +869,48 @@ func TestRho(t *testing.T) {
 	}
 }
 
+// rhoLoop is the old implementation of rho, for comparison.
+func rhoLoop(x uint64) (z uint8) {
+	for bit := uint64(1 << 63); bit&x == 0 && bit > 0; bit >>= 1 {
+		z++
+	}
+	return z + 1
+}
+
+func TestRhoMatchesLoop(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		// vary the number of leading zeros
+		x := rng.Uint64() >> uint(rng.Intn(65))
+		if rho(x) != rhoLoop(x) {
+			t.Fatalf("%#x: got %d, expected %d", x, rho(x), rhoLoop(x))
+		}
+	}
+}
+
+func benchmarkRho(b *testing.B, f func(uint64) uint8) {
+	rng := rand.New(rand.NewSource(1))
+	xs := make([]uint64, 1024)
+	for i := range xs {
+		xs[i] = rng.Uint64() >> uint(rng.Intn(65))
+	}
+
+	b.ResetTimer()
+	var sum uint8
+	for i := 0; i < b.N; i++ {
+		sum += f(xs[i%len(xs)])
+	}
+	_ = sum
+}
+
+func BenchmarkRho(b *testing.B) {
+	benchmarkRho(b, rho)
+}
+
+func BenchmarkRhoLoop(b *testing.B) {
+	benchmarkRho(b, rhoLoop)
+}
+
 func bitsToBytes(bits string) []byte {
 	bits = strings.Replace(bits, " ", "", -1)
 	if len(bits)%8 != 0 {
@@ -618,3 +1036,2713 @@ func TestRegisterPacking(t *testing.T) {
 		t.Errorf("got %d", v)
 	}
 }
+
+func TestExceedsThreshold(t *testing.T) {
+	gen := rand.New(rand.NewSource(2))
+
+	for _, raw := range []bool{false, true} {
+		h, err := NewWithConfig(Config{RawEstimateOnly: raw})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var i uint64
+		for _, count := range []uint64{0, 10, 1000, 5000, 20000, 100000} {
+			for ; i < count; i++ {
+				h.Add(intToBytes(i))
+			}
+
+			c := h.Count()
+			for trial := 0; trial < 100; trial++ {
+				n := uint64(gen.Int63n(int64(2*c + 100)))
+				if got, exp := h.ExceedsThreshold(n), c > n; got != exp {
+					t.Errorf("count %d (raw: %v): got %v for n=%d", c, raw, got, n)
+				}
+			}
+
+			for _, n := range []uint64{c - 1, c, c + 1} {
+				if got, exp := h.ExceedsThreshold(n), c > n; got != exp {
+					t.Errorf("count %d (raw: %v): got %v for n=%d", c, raw, got, n)
+				}
+			}
+		}
+	}
+}
+
+func TestDowngradeOnMerge(t *testing.T) {
+	for _, count := range []uint64{100, 1000, 100000} {
+		h, err := NewWithConfig(Config{DowngradeOnMerge: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		other, err := NewWithConfig(Config{Precision: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// what h should look like after downgrading and merging
+		exp, err := NewWithConfig(Config{Precision: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := uint64(0); i < count; i++ {
+			h.Add(intToBytes(i))
+			exp.Add(intToBytes(i))
+		}
+
+		for i := count; i < count+100; i++ {
+			other.Add(intToBytes(i))
+			exp.Add(intToBytes(i))
+		}
+
+		if err := h.Merge(other); err != nil {
+			t.Fatal(err)
+		}
+
+		if h.p != 10 || h.m != 1<<10 {
+			t.Errorf("count %d: expected p=10, got %d", count, h.p)
+		}
+
+		h.flushTmpSet()
+		exp.flushTmpSet()
+		if h.sparse != exp.sparse || !bytes.Equal(h.data, exp.data) {
+			t.Errorf("count %d: downgraded HLLPP differs from p=10 HLLPP", count)
+		}
+
+		if h.Count() != exp.Count() {
+			t.Errorf("count %d: got %d, expected %d", count, h.Count(), exp.Count())
+		}
+	}
+
+	// without the flag, merging lower precision is an error
+	h := New()
+	other, err := NewWithConfig(Config{Precision: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Add([]byte("foo"))
+
+	err = h.Merge(other)
+	if err == nil || !strings.Contains(err.Error(), "DowngradeOnMerge") {
+		t.Errorf("expected downgrade error, got %v", err)
+	}
+
+	if h.p != 14 || h.Count() != 1 {
+		t.Error("h was modified by failed merge")
+	}
+
+	// can't downgrade the other way
+	h, err = NewWithConfig(Config{Precision: 10, DowngradeOnMerge: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Merge(New()); err == nil {
+		t.Error("expected error merging higher precision")
+	}
+}
+
+func TestMergeFold(t *testing.T) {
+	for _, count := range []uint64{100, 100000} {
+		// what the result should look like in either direction
+		exp := MustNewWithConfig(Config{Precision: 12})
+		for i := uint64(0); i < 2*count; i++ {
+			exp.Add(intToBytes(i))
+		}
+		exp.flushTmpSet()
+
+		for _, swap := range []bool{false, true} {
+			h, other := New(), MustNewWithConfig(Config{Precision: 12})
+			if swap {
+				h, other = other, h
+			}
+			for i := uint64(0); i < count; i++ {
+				h.Add(intToBytes(i))
+				other.Add(intToBytes(i + count))
+			}
+			otherP := other.p
+
+			if err := h.MergeFold(other); err != nil {
+				t.Fatal(err)
+			}
+
+			if h.p != 12 || other.p != otherP {
+				t.Errorf("count %d: got p=%d, other p=%d", count, h.p, other.p)
+			}
+
+			h.flushTmpSet()
+			if h.sparse != exp.sparse || !bytes.Equal(h.data, exp.data) || h.Count() != exp.Count() {
+				t.Errorf("count %d (swap %v): folded union differs from p=12 HLLPP", count, swap)
+			}
+		}
+	}
+
+	other := MustNewWithConfig(Config{Precision: 12, SparsePrecision: 18})
+	if err := New().MergeFold(other); err == nil {
+		t.Error("expected error for different p'")
+	}
+
+	// a failed merge doesn't fold h
+	h := New()
+	if err := h.MergeFold(MustNewWithConfig(Config{Precision: 10, Banks: 2})); err == nil || h.p != 14 {
+		t.Errorf("expected error for different banks with p=14, got %v with p=%d", err, h.p)
+	}
+}
+
+func TestFold(t *testing.T) {
+	for _, count := range []uint64{100, 100000} {
+		h, exp := New(), MustNewWithConfig(Config{Precision: 10})
+		for i := uint64(0); i < count; i++ {
+			h.Add(intToBytes(i))
+			exp.Add(intToBytes(i))
+		}
+
+		before := h.Marshal()
+		if err := h.Fold(14); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(h.Marshal(), before) {
+			t.Errorf("count %d: folding to the same p changed h", count)
+		}
+
+		if err := h.Fold(10); err != nil {
+			t.Fatal(err)
+		}
+
+		exp.flushTmpSet()
+		if h.p != 10 || h.sparse != exp.sparse || !bytes.Equal(h.data, exp.data) || h.Count() != exp.Count() {
+			t.Errorf("count %d: folded HLLPP differs from p=10 HLLPP", count)
+		}
+	}
+
+	h := New()
+	for _, p := range []uint8{3, 15} {
+		if err := h.Fold(p); err == nil {
+			t.Errorf("expected error for p=%d", p)
+		}
+	}
+}
+
+func TestCountExcluding(t *testing.T) {
+	treatment, background := New(), New()
+
+	// treatment fully contains background
+	for i := uint64(0); i < 50000; i++ {
+		treatment.Add(intToBytes(i))
+		if i < 20000 {
+			background.Add(intToBytes(i))
+		}
+	}
+
+	got, err := treatment.CountExcluding(background)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := estimateError(got, 30000); e > 0.05 {
+		t.Errorf("Got %d, expected %d (%f)", got, 30000, e)
+	}
+
+	// background contains treatment, so nothing is left
+	got, err = background.CountExcluding(treatment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got > 1000 {
+		t.Errorf("Got %d, expected ~0", got)
+	}
+
+	// disjoint
+	other := New()
+	for i := uint64(100000); i < 110000; i++ {
+		other.Add(intToBytes(i))
+	}
+
+	got, err = other.CountExcluding(background)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := estimateError(got, 10000); e > 0.05 {
+		t.Errorf("Got %d, expected %d (%f)", got, 10000, e)
+	}
+
+	p12, err := NewWithConfig(Config{Precision: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New().CountExcluding(p12); err == nil {
+		t.Error("expected error for different parameters")
+	}
+}
+
+func TestPrecision(t *testing.T) {
+	h, err := NewWithConfig(Config{Precision: 12, SparsePrecision: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Precision() != 12 || h.SparsePrecision() != 20 {
+		t.Errorf("got p=%d, p'=%d", h.Precision(), h.SparsePrecision())
+	}
+
+	h = New()
+	if h.Precision() != 14 || h.SparsePrecision() != 20 {
+		t.Errorf("got p=%d, p'=%d", h.Precision(), h.SparsePrecision())
+	}
+}
+
+func TestRollUp(t *testing.T) {
+	// group i has 3 overlapping HLLPPs covering [0, 10000*(i+1))
+	groups := make(map[string][]*HLLPP)
+	for g := uint64(0); g < 3; g++ {
+		name := strconv.FormatUint(g, 10)
+		for j := uint64(0); j < 3; j++ {
+			h := New()
+			for i := j * 5000 * (g + 1); i < (j+2)*5000*(g+1); i++ {
+				h.Add(intToBytes(i))
+			}
+			groups[name] = append(groups[name], h)
+		}
+	}
+
+	before := groups["0"][0].Count()
+
+	// with buffered sparse values, which must not be flushed
+	for j := uint64(0); j < 2; j++ {
+		h := New()
+		for i := uint64(0); i < 100; i++ {
+			h.Add(intToBytes(j*50 + i))
+		}
+		groups["pending"] = append(groups["pending"], h)
+	}
+	pending := []*HLLPP{groups["pending"][0].clone(), groups["pending"][1].clone()}
+
+	rolledUp, err := RollUp(groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rolledUp) != 4 {
+		t.Fatalf("got %d groups", len(rolledUp))
+	}
+
+	if got := rolledUp["pending"].Count(); got != 150 {
+		t.Errorf("pending: got %d, expected 150", got)
+	}
+	for i, h := range groups["pending"] {
+		if !reflect.DeepEqual(h, pending[i]) {
+			t.Errorf("pending input %d was modified", i)
+		}
+	}
+
+	for g := uint64(0); g < 3; g++ {
+		exp := 20000 * (g + 1)
+		got := rolledUp[strconv.FormatUint(g, 10)].Count()
+		if e := estimateError(got, exp); e > 0.01 {
+			t.Errorf("group %d: got %d, expected %d (%f)", g, got, exp, e)
+		}
+	}
+
+	if groups["0"][0].Count() != before {
+		t.Error("input HLLPP was modified")
+	}
+
+	p12, err := NewWithConfig(Config{Precision: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups["bad"] = []*HLLPP{New(), p12}
+	if _, err := RollUp(groups); err == nil {
+		t.Error("expected error for incompatible group")
+	}
+
+	if _, err := RollUp(map[string][]*HLLPP{"empty": nil}); err == nil {
+		t.Error("expected error for empty group")
+	}
+}
+
+func TestFillRatio(t *testing.T) {
+	h := New()
+	if h.FillRatio() != 0 {
+		t.Errorf("got %f", h.FillRatio())
+	}
+
+	for i := uint64(0); i < 1000; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	// still sparse
+	exp := 1 - math.Exp(-1000.0/float64(h.m))
+	if got := h.FillRatio(); math.Abs(got-exp) > 0.005 {
+		t.Errorf("got %f, expected %f", got, exp)
+	}
+
+	for i := uint64(1000); i < uint64(h.m); i++ {
+		h.Add(intToBytes(i))
+	}
+
+	if got, exp := h.FillRatio(), 1-1/math.E; math.Abs(got-exp) > 0.01 {
+		t.Errorf("got %f, expected %f", got, exp)
+	}
+}
+
+func TestSetDenseData(t *testing.T) {
+	h := New()
+	for i := uint64(0); i < 50000; i++ {
+		h.Add(intToBytes(i))
+	}
+	h.Add(intToBytes(murmurRho32))
+
+	if h.sparse || h.bitsPerRegister != 6 {
+		t.Fatal("expected dense with 6 bits per register")
+	}
+
+	other, err := SetDenseData(14, 6, append([]byte(nil), h.data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if other.Count() != h.Count() {
+		t.Errorf("got %d, expected %d", other.Count(), h.Count())
+	}
+
+	// can keep adding
+	for i := uint64(50000); i < 60000; i++ {
+		h.Add(intToBytes(i))
+		other.Add(intToBytes(i))
+	}
+
+	if other.Count() != h.Count() {
+		t.Errorf("got %d, expected %d", other.Count(), h.Count())
+	}
+
+	if _, err := SetDenseData(14, 5, h.data); err == nil {
+		t.Error("expected error for wrong length")
+	}
+
+	if _, err := SetDenseData(14, 7, make([]byte, 7*(1<<14)/8)); err == nil {
+		t.Error("expected error for bad bits per register")
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	h, err := NewWithConfig(Config{Precision: 16, MaxBytes: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wasSparse bool
+	for i := uint64(0); i < 100000; i++ {
+		h.Add(intToBytes(i))
+
+		if size := len(h.data) + 4*len(h.tmpSet); size > 4096 {
+			t.Fatalf("%d: size %d over cap", i, size)
+		}
+
+		if i == 300 {
+			wasSparse = h.sparse
+		}
+	}
+
+	if !wasSparse {
+		t.Error("should have started out sparse")
+	}
+
+	// 2^12 registers at 5 bits is the biggest that fits
+	if h.sparse || h.p != 12 {
+		t.Errorf("expected dense p=12, got p=%d (sparse: %v)", h.p, h.sparse)
+	}
+
+	if e := estimateError(h.Count(), 100000); e > 0.05 {
+		t.Errorf("Got %d, expected %d (%f)", h.Count(), 100000, e)
+	}
+
+	// merging keeps us under the cap too
+	h, err = NewWithConfig(Config{MaxBytes: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := New()
+	for i := uint64(0); i < 100000; i++ {
+		other.Add(intToBytes(i))
+	}
+
+	if err := h.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(h.data) > 1000 || h.p != 10 {
+		t.Errorf("expected p=10 under cap, got p=%d with %d bytes", h.p, len(h.data))
+	}
+
+	// and so does MergeTagged
+	h = MustNewWithConfig(Config{MaxBytes: 100})
+	if err := h.MergeTagged(other, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(h.data) > 100 || h.p != 7 {
+		t.Errorf("tagged: expected p=7 under cap, got p=%d with %d bytes", h.p, len(h.data))
+	}
+
+	if e := estimateError(h.Count(), 100000); e > 0.3 {
+		t.Errorf("tagged: Got %d, expected %d (%f)", h.Count(), 100000, e)
+	}
+
+	for _, c := range []Config{{MaxBytes: 11}, {MaxBytes: -1}, {MaxBytes: 1000, Banks: 2}} {
+		if _, err := NewWithConfig(c); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
+
+func TestMergeCapped(t *testing.T) {
+	acc := MustNewWithConfig(Config{Precision: 16})
+
+	// p=16 dense is 48KB; 4096 bytes fits p=12
+	var n uint64
+	for i := 0; i < 5; i++ {
+		other := MustNewWithConfig(Config{Precision: 16})
+		for j := 0; j < 50000; j++ {
+			other.Add(intToBytes(n))
+			n++
+		}
+
+		if err := acc.MergeCapped(other, 4096); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(acc.data) > 4096 {
+			t.Fatalf("%d: %d bytes over cap", i, len(acc.data))
+		}
+
+		if other.p != 16 {
+			t.Fatalf("other was modified")
+		}
+	}
+
+	if acc.sparse || acc.p != 12 {
+		t.Errorf("expected dense p=12, got p=%d (sparse: %v)", acc.p, acc.sparse)
+	}
+
+	// p=12 has twice p=16's expected error
+	if e := estimateError(acc.Count(), n); e > 0.05 {
+		t.Errorf("Got %d, expected %d (%f)", acc.Count(), n, e)
+	}
+
+	// small results aren't folded
+	small := New()
+	other := New()
+	other.Add([]byte("foo"))
+	if err := small.MergeCapped(other, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if small.p != 14 || !small.sparse || small.Count() != 1 {
+		t.Errorf("got p=%d, sparse=%v, count=%d", small.p, small.sparse, small.Count())
+	}
+
+	if err := small.MergeCapped(other, 11); err == nil {
+		t.Error("expected error for max bytes below 12")
+	}
+}
+
+func TestCountWithDetail(t *testing.T) {
+	h := New()
+	for i := uint64(0); i < 1000; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	if d := h.CountWithDetail(); d.Count != h.Count() || d.Clamped {
+		t.Errorf("got %+v", d)
+	}
+
+	// every register saturated implies more than 2^64 values
+	data := make([]byte, 6*(1<<14)/8)
+	for i := uint32(0); i < 1<<14; i++ {
+		setRegister(data, 6, i, 64-14+1)
+	}
+
+	h, err := SetDenseData(14, 6, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	if d := h.CountWithDetail(); d.Count != math.MaxInt64 || !d.Clamped {
+		t.Errorf("got %+v", d)
+	}
+
+	// and adding clamped counts doesn't overflow
+	if sum := h.Count() + h.Count(); sum < h.Count() {
+		t.Errorf("sum overflowed: %d", sum)
+	}
+
+	// registers above 65-p can't happen
+	setRegister(data, 6, 123, 63)
+	if err := h.Validate(); err == nil {
+		t.Error("expected error for register above 65-p")
+	}
+}
+
+func TestAddRepeated(t *testing.T) {
+	h, other := New(), New()
+
+	h.AddRepeated(intToBytes(0), 1000)
+	other.Add(intToBytes(0))
+
+	if h.Count() != other.Count() || !bytes.Equal(h.data, other.data) {
+		t.Errorf("got %d, expected %d", h.Count(), other.Count())
+	}
+
+	h.AddRepeated(intToBytes(1), 0)
+	if h.Count() != 1 {
+		t.Errorf("got %d", h.Count())
+	}
+
+	// every repeat counts toward the volume, saturating
+	h = MustNewWithConfig(Config{TrackVolume: true})
+	h.AddRepeated(intToBytes(0), 1000)
+	h.AddRepeated(intToBytes(1), 1)
+	if got := h.VolumeEstimate(); got != 1001 {
+		t.Errorf("got volume %d, expected 1001", got)
+	}
+
+	h = MustNewWithConfig(Config{TrackVolume: true})
+	h.AddRepeated(intToBytes(0), 100000)
+	if got := h.VolumeEstimate(); got != math.MaxUint16 {
+		t.Errorf("got volume %d, expected %d", got, math.MaxUint16)
+	}
+}
+
+func TestEWMAEstimator(t *testing.T) {
+	if _, err := NewEWMAEstimator(0); err == nil {
+		t.Error("expected error for alpha 0")
+	}
+
+	e, err := NewEWMAEstimator(0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each bucket has a different 5000 values, so counts are noisy around 5000
+	var smoothed float64
+	for bucket := uint64(0); bucket < 30; bucket++ {
+		h, err := NewWithConfig(Config{Precision: 8})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := uint64(0); i < 5000; i++ {
+			h.Add(intToBytes(bucket<<32 | i))
+		}
+
+		smoothed = e.Update(h)
+		if bucket == 0 && smoothed != float64(h.Count()) {
+			t.Errorf("first update: got %f, expected %d", smoothed, h.Count())
+		}
+	}
+
+	if smoothed != e.Value() {
+		t.Errorf("got %f, expected %f", e.Value(), smoothed)
+	}
+
+	if e := math.Abs(smoothed-5000) / 5000; e > 0.05 {
+		t.Errorf("smoothed value %f too far from 5000 (%f)", smoothed, e)
+	}
+}
+
+func TestUpdateHooks(t *testing.T) {
+	var (
+		calls  int
+		sparse = make(map[uint32]uint8)
+		dense  = make(map[uint32]uint8)
+	)
+
+	h, err := NewWithConfig(Config{
+		OnSparseUpdate: func(index uint32, old, new uint8) {
+			calls++
+			if sparse[index] != old || new <= old {
+				t.Errorf("sparse %d: bad update %d => %d (had %d)", index, old, new, sparse[index])
+			}
+			sparse[index] = new
+		},
+		OnRegisterUpdate: func(index uint32, old, new uint8) {
+			calls++
+			if dense[index] != old || new <= old {
+				t.Errorf("dense %d: bad update %d => %d (had %d)", index, old, new, dense[index])
+			}
+			dense[index] = new
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := uint64(0); i < 2000; i++ {
+		h.Add(intToBytes(i))
+	}
+	h.flushTmpSet()
+
+	if !h.sparse || len(sparse) != int(h.sparseLength) || len(dense) > 0 {
+		t.Fatalf("expected %d sparse updates, got %d (%d dense)", h.sparseLength, len(sparse), len(dense))
+	}
+
+	reader := newSparseReader(h.data)
+	for !reader.Done() {
+		k := reader.Next()
+		if _, rho := h.decodeHash(k, h.pp); sparse[h.getIndex(k, h.pp)] != rho {
+			t.Errorf("sparse index %d: got %d, expected %d", h.getIndex(k, h.pp), sparse[h.getIndex(k, h.pp)], rho)
+		}
+	}
+
+	// no changes, no calls
+	calls = 0
+	for i := uint64(0); i < 2000; i++ {
+		h.Add(intToBytes(i))
+	}
+	h.flushTmpSet()
+	if calls != 0 {
+		t.Errorf("got %d calls for no changes", calls)
+	}
+
+	h.toNormal()
+	for i := uint32(0); i < h.m; i++ {
+		dense[i] = getRegister(h.data, h.bitsPerRegister, i)
+	}
+
+	calls = 0
+	for i := uint64(2000); i < 50000; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	if calls == 0 {
+		t.Error("no dense updates")
+	}
+
+	for i := uint32(0); i < h.m; i++ {
+		if got := getRegister(h.data, h.bitsPerRegister, i); dense[i] != got {
+			t.Errorf("register %d: got %d, expected %d", i, dense[i], got)
+		}
+	}
+
+	calls = 0
+	for i := uint64(2000); i < 50000; i++ {
+		h.Add(intToBytes(i))
+	}
+	if calls != 0 {
+		t.Errorf("got %d calls for no changes", calls)
+	}
+}
+
+func TestReadOnlyHelpersSkipHooks(t *testing.T) {
+	var calls int
+	hook := func(index uint32, old, new uint8) { calls++ }
+	c := Config{OnRegisterUpdate: hook, OnSparseUpdate: hook, MinHashSize: 10}
+
+	for _, count := range []uint64{1000, 100000} {
+		h, other := MustNewWithConfig(c), MustNewWithConfig(c)
+		for i := uint64(0); i < count; i++ {
+			h.Add(intToBytes(i))
+			other.Add(intToBytes(i + count/2))
+		}
+		h.flushTmpSet()
+		other.flushTmpSet()
+
+		// an unflushed value, which only a real flush should report
+		h.Add([]byte("pending"))
+
+		low := New()
+		calls = 0
+
+		Combine(h, other)
+		h.CountExcluding(other)
+		h.SymmetricDifferenceCount(other)
+		h.IntersectionCount(other)
+		RollUp(map[string][]*HLLPP{"a": {h, other}})
+		u, _ := NewUnionView(h, other)
+		u.Materialize()
+		h.ExportDense8()
+		h.MarshalFolded(10)
+		low.MergeFold(MustNewWithConfig(Config{Precision: 16, OnSparseUpdate: hook}))
+		MustNewWithConfig(Config{Precision: 10}).MergeCapped(other, 1<<20)
+
+		// only the pending sparse value, once, when h itself flushes it
+		h.flushTmpSet()
+		var exp int
+		if h.sparse {
+			exp = 1
+		}
+		if calls != exp {
+			t.Errorf("count %d: got %d hook calls, expected %d", count, calls, exp)
+		}
+	}
+}
+
+func TestIgnoreEmpty(t *testing.T) {
+	h := New()
+	h.Add(nil)
+	h.Add([]byte{})
+	if h.Count() != 1 {
+		t.Errorf("got %d, expected 1", h.Count())
+	}
+
+	h, err := NewWithConfig(Config{IgnoreEmpty: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Add(nil)
+	h.Add([]byte{})
+	if h.Count() != 0 {
+		t.Errorf("got %d, expected 0", h.Count())
+	}
+
+	h.Add([]byte("foo"))
+	if h.Count() != 1 {
+		t.Errorf("got %d, expected 1", h.Count())
+	}
+}
+
+func TestAbsoluteError(t *testing.T) {
+	h := New()
+	if h.AbsoluteError() != 0 {
+		t.Errorf("got %d", h.AbsoluteError())
+	}
+
+	if e := h.RelativeError(); math.Abs(e-0.008125) > 0.0001 {
+		t.Errorf("got relative error %f", e)
+	}
+
+	var last uint64
+	for _, count := range []uint64{1000, 10000, 100000} {
+		for i := uint64(0); i < count; i++ {
+			h.Add(intToBytes(i))
+		}
+
+		got := h.AbsoluteError()
+		exp := uint64(h.RelativeError()*float64(h.Count()) + 0.5)
+		if got != exp || got <= last {
+			t.Errorf("count %d: got %d, expected %d (last %d)", count, got, exp, last)
+		}
+		last = got
+	}
+}
+
+func TestMergeChanged(t *testing.T) {
+	for _, count := range []uint64{1000, 100000} {
+		h, subset := New(), New()
+		for i := uint64(0); i < count; i++ {
+			h.Add(intToBytes(i))
+			if i%3 == 0 {
+				subset.Add(intToBytes(i))
+			}
+		}
+
+		changed, err := h.MergeChanged(subset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed {
+			t.Errorf("count %d: subset merge reported change", count)
+		}
+
+		// enough new values that some register must go up
+		other := New()
+		for i := count; i < count+1000; i++ {
+			other.Add(intToBytes(i))
+		}
+
+		changed, err = h.MergeChanged(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !changed {
+			t.Errorf("count %d: new value merge reported no change", count)
+		}
+
+		// merging the same thing again does nothing
+		changed, err = h.MergeChanged(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed {
+			t.Errorf("count %d: repeated merge reported change", count)
+		}
+
+		if h.onRegisterUpdate != nil || h.onSparseUpdate != nil {
+			t.Error("hooks not restored")
+		}
+	}
+
+	// sparse h, dense subset
+	h, dense := New(), New()
+	for i := uint64(0); i < 100000; i++ {
+		dense.Add(intToBytes(i))
+	}
+	changed, err := h.MergeChanged(dense)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("merge into empty reported no change")
+	}
+}
+
+func TestKeyedAggregator(t *testing.T) {
+	a := NewKeyedAggregator()
+
+	// key i gets 4 overlapping estimators covering [0, 1000*(i+1))
+	for j := uint64(0); j < 4; j++ {
+		for k := uint64(0); k < 3; k++ {
+			h := New()
+			for i := j * 250 * (k + 1); i < (j+1)*250*(k+1); i++ {
+				h.Add(intToBytes(i))
+				h.Add(intToBytes(i / 2))
+			}
+
+			if err := a.Add(strconv.FormatUint(k, 10), h.Marshal()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	groups := a.Flush()
+	if len(groups) != 3 {
+		t.Fatalf("got %d groups", len(groups))
+	}
+
+	for k := uint64(0); k < 3; k++ {
+		exp := 1000 * (k + 1)
+		got := groups[strconv.FormatUint(k, 10)].Count()
+		if e := estimateError(got, exp); e > 0.01 {
+			t.Errorf("key %d: got %d, expected %d (%f)", k, got, exp, e)
+		}
+	}
+
+	if len(a.Flush()) != 0 {
+		t.Error("expected empty after flush")
+	}
+
+	p12, err := NewWithConfig(Config{Precision: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Add("x", New().Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Add("x", p12.Marshal()); err == nil {
+		t.Error("expected error for incompatible estimator")
+	}
+	if err := a.Add("x", []byte{1}); err == nil {
+		t.Error("expected error for bad data")
+	}
+}
+
+func TestLinearCount(t *testing.T) {
+	h := New()
+	for i := uint64(0); i < 1000; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	pending := len(h.tmpSet)
+	if got := h.LinearCount(); got != h.Count() {
+		t.Errorf("sparse: got %d, expected %d", got, h.Count())
+	}
+	if pending == 0 {
+		t.Error("expected pending values")
+	}
+
+	for i := uint64(1000); i < 30000; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	var numZeros uint32
+	for i := uint32(0); i < h.m; i++ {
+		if getRegister(h.data, h.bitsPerRegister, i) == 0 {
+			numZeros++
+		}
+	}
+
+	exp := uint64(float64(h.m)*math.Log(float64(h.m)/float64(numZeros)) + 0.5)
+	if got := h.LinearCount(); got != exp {
+		t.Errorf("dense: got %d, expected %d", got, exp)
+	}
+
+	// past the linear counting threshold, so Count doesn't use it
+	if h.LinearCount() == h.Count() {
+		t.Error("expected linear count to differ from count")
+	}
+}
+
+func TestSeedCardinality(t *testing.T) {
+	for _, n := range []uint64{1000, 100000, 10000000} {
+		h := New()
+		SeedCardinality(h, n)
+
+		if e := estimateError(h.Count(), n); e > 0.03 {
+			t.Errorf("Got %d, expected %d (%f)", h.Count(), n, e)
+		}
+	}
+
+	// values already in h are kept
+	h := New()
+	for i := uint64(0); i < 50000; i++ {
+		h.Add(intToBytes(i))
+	}
+	SeedCardinality(h, 100000)
+	if e := estimateError(h.Count(), 150000); e > 0.03 {
+		t.Errorf("Got %d, expected %d (%f)", h.Count(), 150000, e)
+	}
+
+	// each bank gets its own random registers
+	h = MustNewWithConfig(Config{Banks: 4})
+	SeedCardinality(h, 100000)
+	for i, bank := range h.banks {
+		if bytes.Equal(bank.data, h.data) {
+			t.Errorf("bank %d has the same registers as h", i)
+		}
+		for j := i + 1; j < len(h.banks); j++ {
+			if bytes.Equal(bank.data, h.banks[j].data) {
+				t.Errorf("banks %d and %d have the same registers", i, j)
+			}
+		}
+	}
+}
+
+func TestStartDense(t *testing.T) {
+	h, err := NewWithConfig(Config{StartDense: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.sparse || len(h.data) != p14NormalSize*5/6 {
+		t.Fatal("expected dense")
+	}
+
+	normal := New()
+	for i := uint64(0); i < 200000; i++ {
+		h.Add(intToBytes(i))
+		normal.Add(intToBytes(i))
+
+		if h.sparse {
+			t.Fatal("became sparse")
+		}
+	}
+
+	if h.Count() != normal.Count() {
+		t.Errorf("got %d, expected %d", h.Count(), normal.Count())
+	}
+
+	if err := marshalUnmarshal(h); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEstimatedRelativeError(t *testing.T) {
+	h := New()
+	if h.EstimatedRelativeError() != 0 {
+		t.Errorf("got %f", h.EstimatedRelativeError())
+	}
+
+	for i := uint64(0); i < 1000; i++ {
+		h.Add(intToBytes(i))
+	}
+	sparse := h.EstimatedRelativeError()
+
+	for i := uint64(1000); i < 5000; i++ {
+		h.Add(intToBytes(i))
+	}
+	h.flushTmpSet()
+	h.toNormal()
+	linear := h.EstimatedRelativeError()
+
+	for i := uint64(5000); i < 100000; i++ {
+		h.Add(intToBytes(i))
+	}
+	standard := h.EstimatedRelativeError()
+
+	if standard != h.RelativeError() {
+		t.Errorf("got %f, expected %f", standard, h.RelativeError())
+	}
+
+	if !(sparse < linear && linear < standard) {
+		t.Errorf("expected increasing errors, got %f, %f, %f", sparse, linear, standard)
+	}
+
+	// all registers saturated
+	data := make([]byte, 6*(1<<14)/8)
+	for i := uint32(0); i < 1<<14; i++ {
+		setRegister(data, 6, i, 64-14+1)
+	}
+	h, err := SetDenseData(14, 6, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !math.IsInf(h.EstimatedRelativeError(), 1) {
+		t.Errorf("got %f", h.EstimatedRelativeError())
+	}
+}
+
+func TestDenseRegisters(t *testing.T) {
+	h := New()
+	if _, err := h.DenseRegisters(); err == nil {
+		t.Error("expected error for sparse")
+	}
+
+	for i := uint64(0); i < 100000; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	for _, bits := range []uint32{5, 6} {
+		if bits == 6 {
+			h.Add(intToBytes(murmurRho32))
+		}
+
+		registers, err := h.DenseRegisters()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(registers) != int(h.m) {
+			t.Fatalf("got %d registers", len(registers))
+		}
+
+		other, err := NewDenseFromRegisters(14, registers)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if other.bitsPerRegister != bits || !bytes.Equal(other.data, h.data) || other.Count() != h.Count() {
+			t.Errorf("%d bits: round trip mismatch", bits)
+		}
+	}
+
+	if _, err := NewDenseFromRegisters(14, make([]uint8, 100)); err == nil {
+		t.Error("expected error for wrong length")
+	}
+
+	registers := make([]uint8, 1<<14)
+	registers[5] = 52
+	if _, err := NewDenseFromRegisters(14, registers); err == nil {
+		t.Error("expected error for impossible register")
+	}
+}
+
+func TestCountCache(t *testing.T) {
+	h, fresh := New(), New()
+	for i := uint64(0); i < 100000; i++ {
+		h.Add(intToBytes(i))
+		fresh.Add(intToBytes(i))
+
+		if i%1000 == 0 {
+			fresh.countVersion = 0
+			if got, exp := h.Count(), fresh.Count(); got != exp {
+				t.Fatalf("%d: got %d, expected %d", i, got, exp)
+			}
+		}
+	}
+
+	// back to back Counts use the cache
+	h.Count()
+	h.cachedCount = 12345
+	if h.Count() != 12345 {
+		t.Error("expected cached count")
+	}
+
+	// any modification invalidates it
+	other := New()
+	if err := h.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	if h.Count() == 12345 {
+		t.Error("expected fresh count after Merge")
+	}
+
+	h.Count()
+	h.cachedCount = 12345
+	for i := uint64(100000); i < 101000; i++ {
+		h.Add(intToBytes(i))
+	}
+	if h.Count() == 12345 {
+		t.Error("expected fresh count after Add")
+	}
+
+	// adding a value that doesn't change a dense register keeps it
+	h.Count()
+	h.cachedCount = 12345
+	h.Add(intToBytes(0))
+	if h.Count() != 12345 {
+		t.Error("expected cached count after adding duplicate")
+	}
+}
+
+func TestTrackVolume(t *testing.T) {
+	h, err := NewWithConfig(Config{TrackVolume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 20000 distinct values, 5 times each
+	for round := 0; round < 5; round++ {
+		for i := uint64(0); i < 20000; i++ {
+			h.Add(intToBytes(i))
+		}
+	}
+
+	if got := h.VolumeEstimate(); got != 100000 {
+		t.Errorf("got volume %d, expected %d", got, 100000)
+	}
+
+	if e := estimateError(h.Count(), 20000); e > 0.02 {
+		t.Errorf("Got %d, expected %d (%f)", h.Count(), 20000, e)
+	}
+
+	other, err := NewWithConfig(Config{TrackVolume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < 1000; i++ {
+		other.Add(intToBytes(i))
+	}
+
+	if err := h.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.VolumeEstimate(); got != 101000 {
+		t.Errorf("got volume %d, expected %d", got, 101000)
+	}
+
+	if err := marshalUnmarshal(h); err != nil {
+		t.Error(err)
+	}
+	if err := marshalUnmarshal(other); err != nil {
+		t.Error(err)
+	}
+
+	data := other.Marshal()
+	if got, err := CountFromMarshaled(data); err != nil || got != other.Count() {
+		t.Errorf("got %d (%v), expected %d", got, err, other.Count())
+	}
+
+	h.fold(10)
+	if got := h.VolumeEstimate(); got != 101000 {
+		t.Errorf("got volume %d after fold, expected %d", got, 101000)
+	}
+
+	if New().VolumeEstimate() != 0 {
+		t.Error("expected 0 volume without tracking")
+	}
+}
+
+func TestAllZerosHash(t *testing.T) {
+	newP25 := func(startDense bool) *HLLPP {
+		h, err := NewWithConfig(Config{SparsePrecision: 25, StartDense: startDense})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	// the all zeros hash, and hashes that are all zeros after the index,
+	// have the biggest possible rho at p=14
+	const maxRho = 64 - 14 + 1
+
+	h := newP25(false)
+	for idx := uint64(0); idx < 100; idx++ {
+		h.addHash(idx << (64 - 14))
+	}
+	// all zeros but the last bit is one less than the max
+	h.addHash(100<<(64-14) | 1)
+
+	if !h.sparse {
+		t.Fatal("expected sparse")
+	}
+
+	if h.Count() != 101 {
+		t.Errorf("got %d, expected 101", h.Count())
+	}
+
+	h.toNormal()
+	if h.bitsPerRegister != 6 {
+		t.Errorf("expected 6 bits per register, got %d", h.bitsPerRegister)
+	}
+
+	for idx := uint32(0); idx < 101; idx++ {
+		exp := uint8(maxRho)
+		if idx == 100 {
+			exp--
+		}
+		if got := getRegister(h.data, h.bitsPerRegister, idx); got != exp {
+			t.Errorf("register %d: got %d, expected %d", idx, got, exp)
+		}
+	}
+
+	// dense: promoted to 6 bits exactly once
+	h, normal := newP25(true), newP25(true)
+	for i := uint64(0); i < 50000; i++ {
+		h.Add(intToBytes(i))
+		normal.Add(intToBytes(i))
+	}
+
+	var promotions int
+	for idx := uint64(0); idx < 1000; idx++ {
+		before := h.bitsPerRegister
+		h.addHash(idx << (64 - 14))
+		if h.bitsPerRegister != before {
+			promotions++
+		}
+	}
+
+	if promotions != 1 || h.bitsPerRegister != 6 {
+		t.Errorf("got %d promotions to %d bits", promotions, h.bitsPerRegister)
+	}
+
+	for idx := uint32(0); idx < 1000; idx++ {
+		if got := getRegister(h.data, h.bitsPerRegister, idx); got != maxRho {
+			t.Errorf("register %d: got %d, expected %d", idx, got, maxRho)
+		}
+	}
+
+	// 1000 huge registers only shrink the harmonic sum a bit, so the count
+	// should only go up a bit
+	if h.Count() <= normal.Count() || estimateError(h.Count(), normal.Count()) > 0.1 {
+		t.Errorf("got %d, expected a bit more than %d", h.Count(), normal.Count())
+	}
+}
+
+func TestSymmetricDifferenceCount(t *testing.T) {
+	h, other := New(), New()
+
+	// [0, 60000) and [40000, 100000): 40000 only in each
+	for i := uint64(0); i < 60000; i++ {
+		h.Add(intToBytes(i))
+		other.Add(intToBytes(i + 40000))
+	}
+
+	got, err := h.SymmetricDifferenceCount(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e := estimateError(got, 80000); e > 0.05 {
+		t.Errorf("Got %d, expected %d (%f)", got, 80000, e)
+	}
+
+	// same set
+	got, err = h.SymmetricDifferenceCount(h.clone())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 0 {
+		t.Errorf("got %d for identical sets", got)
+	}
+
+	p12, err := NewWithConfig(Config{Precision: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.SymmetricDifferenceCount(p12); err == nil {
+		t.Error("expected error for different parameters")
+	}
+}
+
+func TestRegisterDifferenceCount(t *testing.T) {
+	h, other := New(), New()
+	for i := uint64(0); i < 100000; i++ {
+		h.Add(intToBytes(i))
+		other.Add(intToBytes(i + 1000000))
+	}
+
+	got, err := h.RegisterDifferenceCount(h.clone())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 0 {
+		t.Errorf("got %d for identical sketches", got)
+	}
+
+	// most registers differ for disjoint sets this big
+	got, err = h.RegisterDifferenceCount(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got < h.m/2 {
+		t.Errorf("got %d of %d for disjoint sketches", got, h.m)
+	}
+
+	// sparse vs. its dense equivalent
+	sparse := New()
+	for i := uint64(0); i < 100; i++ {
+		sparse.Add(intToBytes(i))
+	}
+	dense := sparse.clone()
+	dense.flushTmpSet()
+	dense.toNormal()
+
+	got, err = sparse.RegisterDifferenceCount(dense)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 0 || !sparse.sparse {
+		t.Errorf("got %d, sparse=%v", got, sparse.sparse)
+	}
+
+	p12 := MustNewWithConfig(Config{Precision: 12})
+	if _, err := h.RegisterDifferenceCount(p12); err == nil {
+		t.Error("expected error for different parameters")
+	}
+}
+
+func TestLinearCountingMaxFactor(t *testing.T) {
+	h := New()
+	wide, err := NewWithConfig(Config{LinearCountingMaxFactor: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := uint64(0); i < 20000; i++ {
+		h.Add(intToBytes(i))
+		wide.Add(intToBytes(i))
+	}
+
+	// past the default threshold, but below 3m
+	if h.Count() == h.LinearCount() {
+		t.Error("default shouldn't use linear counting")
+	}
+
+	if wide.Count() != wide.LinearCount() {
+		t.Errorf("got %d, expected linear count %d", wide.Count(), wide.LinearCount())
+	}
+
+	if e := estimateError(wide.Count(), 20000); e > 0.02 {
+		t.Errorf("Got %d, expected %d (%f)", wide.Count(), 20000, e)
+	}
+
+	if _, err := NewWithConfig(Config{LinearCountingMaxFactor: -1}); err == nil {
+		t.Error("expected error for negative factor")
+	}
+}
+
+func TestUnionView(t *testing.T) {
+	build := func(start, end uint64, dense bool) *HLLPP {
+		h, err := NewWithConfig(Config{StartDense: dense})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := start; i < end; i++ {
+			h.Add(intToBytes(i))
+		}
+		return h
+	}
+
+	cases := [][]*HLLPP{
+		{build(0, 1000, false)},
+		{build(0, 1000, false), build(500, 1500, false), build(1400, 2000, false)},
+		// sparse members, but the union is big enough to be dense
+		{build(0, 4000, false), build(4000, 8000, false), build(8000, 12000, false)},
+		{build(0, 1000, false), build(0, 100000, false), build(50000, 60000, false)},
+		{build(0, 50000, true), build(40000, 100000, true)},
+		{build(0, 100, true), build(100, 200, false)},
+		// a mostly empty dense member merges into sparse as sparse
+		{build(0, 3000, false), build(3000, 3100, true)},
+		{build(0, 100, false), build(50, 200, true), build(150, 400, false), build(300, 350, true)},
+		{build(0, 0, false), build(0, 100, true), build(50, 200, false)},
+		{build(0, 100, false), build(0, 0, true)},
+	}
+
+	for i, hs := range cases {
+		u, err := NewUnionView(hs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		merged, err := u.Materialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got, exp := u.Count(), merged.Count(); got != exp {
+			t.Errorf("case %d: got %d, expected %d", i, got, exp)
+		}
+	}
+
+	if _, err := NewUnionView(); err == nil {
+		t.Error("expected error for no HLLPPs")
+	}
+
+	p12, err := NewWithConfig(Config{Precision: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewUnionView(New(), p12); err == nil {
+		t.Error("expected error for different parameters")
+	}
+}
+
+func TestHealth(t *testing.T) {
+	h := New()
+	if ok, relErr := h.Health(0, 0); !ok || relErr != 0 {
+		t.Errorf("empty: got %v, %f", ok, relErr)
+	}
+
+	for i := uint64(0); i < 100000; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	exp := estimateError(h.Count(), 100000)
+	if ok, relErr := h.Health(100000, 0.02); !ok || relErr != exp {
+		t.Errorf("got %v, %f, expected %f", ok, relErr, exp)
+	}
+
+	if ok, relErr := h.Health(50000, 0.02); ok || math.Abs(relErr-1) > 0.02 {
+		t.Errorf("got %v, %f", ok, relErr)
+	}
+
+	if ok, relErr := h.Health(0, 0.02); ok || !math.IsInf(relErr, 1) {
+		t.Errorf("got %v, %f", ok, relErr)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	h := New()
+	if err := h.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	for i := uint64(0); i < 100000; i++ {
+		h.Add(intToBytes(i))
+	}
+	if err := h.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// e.g. decoded by a serialization framework that skipped NewWithConfig
+	var zero HLLPP
+	if err := zero.Validate(); err == nil {
+		t.Error("expected error for zero value")
+	}
+
+	if err := h.Merge(&zero); err == nil {
+		t.Error("expected error merging zero value")
+	}
+
+	if err := zero.Merge(h); err == nil {
+		t.Error("expected error merging into zero value")
+	}
+
+	bad := h.clone()
+	bad.data = bad.data[:100]
+	if err := bad.Validate(); err == nil {
+		t.Error("expected error for truncated data")
+	}
+
+	bad = h.clone()
+	bad.p = 0
+	if err := bad.Validate(); err == nil {
+		t.Error("expected error for p=0")
+	}
+}
+
+func TestCountPending(t *testing.T) {
+	h := New()
+	for i := uint64(0); i < 3000; i++ {
+		h.Add(intToBytes(i))
+		h.Add(intToBytes(i / 2))
+	}
+
+	pending, data := len(h.tmpSet), h.data
+	first := h.CountPending()
+	if pending == 0 || len(h.tmpSet) != pending || !bytes.Equal(h.data, data) {
+		t.Fatal("CountPending modified h")
+	}
+
+	if second := h.CountPending(); second != first {
+		t.Errorf("got %d, then %d", first, second)
+	}
+
+	h.flushTmpSet()
+	if got := h.Count(); got != first {
+		t.Errorf("got %d after flush, expected %d", got, first)
+	}
+}
+
+func TestMergeMostlyEmptyDense(t *testing.T) {
+	h := New()
+	for i := uint64(0); i < 500; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	other, err := NewWithConfig(Config{StartDense: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// half overlapping h
+	for i := uint64(250); i < 750; i++ {
+		other.Add(intToBytes(i))
+	}
+
+	// registers should end up the same as a normal dense merge
+	exp := h.clone()
+	exp.flushTmpSet()
+	exp.toNormal()
+	if err := exp.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if !h.sparse {
+		t.Fatal("expected to stay sparse")
+	}
+
+	if e := estimateError(h.Count(), 750); e > 0.02 {
+		t.Errorf("Got %d, expected %d (%f)", h.Count(), 750, e)
+	}
+
+	h.toNormal()
+	if !bytes.Equal(h.data, exp.data) {
+		t.Error("registers differ from dense merge")
+	}
+
+	// a fuller dense other still converts h
+	h = New()
+	h.Add(intToBytes(0))
+	for i := uint64(0); i < 5000; i++ {
+		other.Add(intToBytes(i))
+	}
+	if err := h.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	if h.sparse {
+		t.Error("expected dense")
+	}
+}
+
+func TestNormalizeRepresentation(t *testing.T) {
+	h := New()
+
+	// write sparse data directly, skipping the conversion to dense
+	var tmpSet []uint32
+	for i := uint64(0); i < 20000; i++ {
+		tmpSet = append(tmpSet, h.encodeHash(murmurSum64(intToBytes(i))))
+	}
+	sort.Slice(tmpSet, func(i, j int) bool {
+		return h.getIndex(tmpSet[i], h.pp) < h.getIndex(tmpSet[j], h.pp)
+	})
+	writer := newSparseWriter()
+	h.mergeSparseData(nil, tmpSet, writer.Append)
+	h.data = writer.Bytes()
+	h.sparseLength = writer.Len()
+
+	if !h.sparse || !h.sparseTooBig() {
+		t.Fatal("expected oversized sparse data")
+	}
+
+	if err := h.Validate(); err == nil {
+		t.Error("expected validation error")
+	}
+
+	before := h.Count()
+
+	uh, err := Unmarshal(h.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uh.sparse || uh.Validate() != nil {
+		t.Error("expected Unmarshal to normalize")
+	}
+
+	if got, err := CountFromMarshaled(h.Marshal()); err != nil || got != uh.Count() {
+		t.Errorf("got %d from marshaled, expected %d (%v)", got, uh.Count(), err)
+	}
+
+	h.NormalizeRepresentation()
+
+	if h.sparse {
+		t.Error("expected dense")
+	}
+
+	if err := h.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	if h.Count() != uh.Count() {
+		t.Errorf("got %d, unmarshaled %d", h.Count(), uh.Count())
+	}
+
+	if e := estimateError(h.Count(), before); e > 0.02 {
+		t.Errorf("count changed from %d to %d (%f)", before, h.Count(), e)
+	}
+}
+
+func TestExpectedUnionCount(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for _, c := range []struct {
+		cardinalities []uint64
+		universe      uint64
+	}{
+		{[]uint64{10, 10}, 20},
+		{[]uint64{50, 30, 20}, 100},
+		{[]uint64{5, 5, 5, 5, 5}, 1000},
+		{[]uint64{900}, 1000},
+	} {
+		const trials = 2000
+
+		var total uint64
+		seen := make([]bool, c.universe)
+		for trial := 0; trial < trials; trial++ {
+			for i := range seen {
+				seen[i] = false
+			}
+
+			for _, card := range c.cardinalities {
+				for _, v := range rng.Perm(int(c.universe))[:card] {
+					seen[v] = true
+				}
+			}
+
+			for _, s := range seen {
+				if s {
+					total++
+				}
+			}
+		}
+
+		simulated := float64(total) / trials
+		got := ExpectedUnionCount(c.cardinalities, c.universe)
+		if math.Abs(float64(got)-simulated) > 1 {
+			t.Errorf("%v of %d: got %d, simulated %f", c.cardinalities, c.universe, got, simulated)
+		}
+	}
+
+	if got := ExpectedUnionCount([]uint64{10, 200}, 100); got != 100 {
+		t.Errorf("got %d, expected 100", got)
+	}
+
+	if got := ExpectedUnionCount(nil, 100); got != 0 {
+		t.Errorf("got %d, expected 0", got)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	h := New()
+	for i := uint64(0); i < 1000; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	// sparse counts this small are exact
+	if got := h.Coverage(4000); got != float64(h.Count())/4000 || math.Abs(got-0.25) > 0.01 {
+		t.Errorf("got %f, expected ~0.25", got)
+	}
+
+	if got := h.Coverage(500); got != 1 {
+		t.Errorf("got %f, expected 1", got)
+	}
+
+	if got := h.Coverage(0); got != 0 {
+		t.Errorf("got %f, expected 0", got)
+	}
+
+	if got := New().Coverage(100); got != 0 {
+		t.Errorf("got %f, expected 0", got)
+	}
+}
+
+func TestSaturatedRegisters(t *testing.T) {
+	h := New()
+	for i := uint64(0); i < 100000; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	if count, max := h.SaturatedRegisters(); count != 0 || max != 51 {
+		t.Errorf("got %d registers at %d, expected 0 at 51", count, max)
+	}
+
+	// 31 is the biggest 5 bit value, but registers just widen past it
+	registers := make([]uint8, 1<<14)
+	for i := 0; i < 100; i++ {
+		registers[i*7] = 51
+		registers[i*7+1] = 50
+		registers[i*7+2] = 31
+	}
+	h, err := NewDenseFromRegisters(14, registers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count, max := h.SaturatedRegisters(); count != 100 || max != 51 {
+		t.Errorf("got %d registers at %d, expected 100 at 51", count, max)
+	}
+
+	h, err = NewWithConfig(Config{Precision: 4, StartDense: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.updateRegisterIfBigger(3, 61)
+	if count, max := h.SaturatedRegisters(); count != 1 || max != 61 {
+		t.Errorf("got %d registers at %d, expected 1 at 61", count, max)
+	}
+
+	if count, max := New().SaturatedRegisters(); count != 0 || max != 0 {
+		t.Errorf("sparse: got %d registers at %d", count, max)
+	}
+}
+
+func TestMergeIntoEmpty(t *testing.T) {
+	for _, count := range []uint64{0, 1000, 100000} {
+		other := New()
+		for i := uint64(0); i < count; i++ {
+			other.Add(intToBytes(i))
+		}
+
+		h := New()
+		if err := h.Merge(other); err != nil {
+			t.Fatal(err)
+		}
+
+		if !hllpEqual(*h, *other) {
+			t.Errorf("count %d: got %+v, expected %+v", count, h, other)
+		}
+
+		if h.Count() != other.Count() {
+			t.Errorf("count %d: got %d, expected %d", count, h.Count(), other.Count())
+		}
+
+		if len(h.data) > 0 && &h.data[0] == &other.data[0] {
+			t.Errorf("count %d: h shares data with other", count)
+		}
+	}
+}
+
+func benchmarkMerge(b *testing.B, newH func() *HLLPP) {
+	other := New()
+	for i := uint64(0); i < 100000; i++ {
+		other.Add(intToBytes(i))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := newH().Merge(other); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMergeIntoEmpty(b *testing.B) {
+	benchmarkMerge(b, New)
+}
+
+func BenchmarkMergeIntoNonEmpty(b *testing.B) {
+	benchmarkMerge(b, func() *HLLPP {
+		h := New()
+		h.Add([]byte("foo"))
+		return h
+	})
+}
+
+func TestExpectedDenseBytes(t *testing.T) {
+	h := New()
+	h.Add([]byte("foo"))
+
+	expected := h.ExpectedDenseBytes()
+	if expected != 12288 {
+		t.Errorf("got %d, expected 12288", expected)
+	}
+
+	h.flushTmpSet()
+	h.toNormal()
+	if len(h.data) > expected || h.ExpectedDenseBytes() != len(h.data) {
+		t.Errorf("got %d, data is %d bytes", h.ExpectedDenseBytes(), len(h.data))
+	}
+
+	h.updateRegisterIfBigger(0, 40)
+	if h.ExpectedDenseBytes() != len(h.data) || len(h.data) != expected {
+		t.Errorf("got %d, data is %d bytes", h.ExpectedDenseBytes(), len(h.data))
+	}
+}
+
+func TestMustNewWithConfig(t *testing.T) {
+	h := MustNewWithConfig(Config{Precision: 10})
+	if h.Precision() != 10 {
+		t.Errorf("got p=%d", h.Precision())
+	}
+
+	_, expErr := NewWithConfig(Config{Precision: 20})
+	if expErr == nil {
+		t.Fatal("expected error")
+	}
+
+	defer func() {
+		r := recover()
+		if err, ok := r.(error); !ok || err.Error() != expErr.Error() {
+			t.Errorf("got panic %v, expected %v", r, expErr)
+		}
+	}()
+	MustNewWithConfig(Config{Precision: 20})
+	t.Error("expected panic")
+}
+
+func TestAddAndDelta(t *testing.T) {
+	for _, n := range []uint64{1000, 10000} {
+		h := New()
+
+		var sum int64
+		for i := uint64(0); i < n; i++ {
+			sum += h.AddAndDelta(intToBytes(i))
+		}
+
+		if sum != int64(h.Count()) {
+			t.Errorf("got sum %d, expected %d", sum, h.Count())
+		}
+
+		if e := estimateError(uint64(sum), n); e > 0.02 {
+			t.Errorf("Got %d, expected %d (%f)", sum, n, e)
+		}
+
+		// duplicates add nothing
+		if delta := h.AddAndDelta(intToBytes(0)); delta != 0 {
+			t.Errorf("got delta %d for duplicate", delta)
+		}
+	}
+
+	// each delta matches Count while sparse, with duplicates in between
+	h := New()
+	count := int64(h.Count())
+	for i := uint64(0); i < 2000; i++ {
+		count += h.AddAndDelta(intToBytes(i % 500 * 7))
+		if count != int64(h.Count()) {
+			t.Fatalf("after %d: got %d, expected %d", i, count, h.Count())
+		}
+	}
+	if !h.sparse {
+		t.Error("expected h to stay sparse")
+	}
+}
+
+func TestMergeMixedRegisterWidths(t *testing.T) {
+	// hash for register idx with the given rho (p=14)
+	hash := func(idx uint64, r uint) uint64 {
+		return idx<<50 | 1<<(50-r)
+	}
+
+	newDense := func() *HLLPP {
+		h, err := NewWithConfig(Config{StartDense: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	for _, narrowIntoWide := range []bool{false, true} {
+		narrow, wide := newDense(), newDense()
+
+		for idx := uint64(0); idx < 100; idx++ {
+			narrow.addHash(hash(idx, uint(idx%31)+1))
+			wide.addHash(hash(idx, uint(30-idx%31)+1))
+		}
+		wide.addHash(hash(200, 40))
+		narrow.addHash(hash(201, 31))
+
+		if narrow.bitsPerRegister != 5 || wide.bitsPerRegister != 6 {
+			t.Fatalf("got widths %d and %d", narrow.bitsPerRegister, wide.bitsPerRegister)
+		}
+
+		expected := make([]uint8, 1<<14)
+		for _, h := range []*HLLPP{narrow, wide} {
+			registers, _ := h.DenseRegisters()
+			for i, r := range registers {
+				if r > expected[i] {
+					expected[i] = r
+				}
+			}
+		}
+
+		dst, src := wide, narrow
+		if !narrowIntoWide {
+			dst, src = narrow, wide
+		}
+		if err := dst.Merge(src); err != nil {
+			t.Fatal(err)
+		}
+
+		if dst.bitsPerRegister != 6 {
+			t.Errorf("narrowIntoWide=%v: got %d bits per register", narrowIntoWide, dst.bitsPerRegister)
+		}
+
+		registers, _ := dst.DenseRegisters()
+		if !reflect.DeepEqual(registers, expected) {
+			t.Errorf("narrowIntoWide=%v: wrong registers", narrowIntoWide)
+		}
+	}
+}
+
+func TestResetDense(t *testing.T) {
+	h := New()
+	for i := uint64(0); i < 100000; i++ {
+		h.Add(intToBytes(i))
+	}
+	h.updateRegisterIfBigger(0, 40)
+
+	data := h.data
+	h.ResetDense()
+
+	if h.Count() != 0 || h.sparse || h.bitsPerRegister != 6 {
+		t.Errorf("got count %d, sparse %v, %d bits", h.Count(), h.sparse, h.bitsPerRegister)
+	}
+
+	if &h.data[0] != &data[0] {
+		t.Error("expected data to be reused")
+	}
+
+	for i := uint64(0); i < 1000; i++ {
+		h.Add(intToBytes(i))
+	}
+	if e := estimateError(h.Count(), 1000); e > 0.05 {
+		t.Errorf("Got %d, expected %d (%f)", h.Count(), 1000, e)
+	}
+
+	// sparse becomes empty dense
+	h = New()
+	h.Add([]byte("foo"))
+	h.ResetDense()
+	if h.Count() != 0 || h.sparse || h.Validate() != nil {
+		t.Errorf("got count %d, sparse %v, %v", h.Count(), h.sparse, h.Validate())
+	}
+
+	// the rest of the state is cleared like Reset, including for banks
+	for _, c := range []Config{
+		{Precision: 10, Debug: true, AssertMonotonic: true},
+		{Precision: 10, Debug: true, Banks: 2},
+	} {
+		h = MustNewWithConfig(c)
+		for i := uint64(0); i < 10000; i++ {
+			h.Add(intToBytes(i))
+		}
+
+		if c.Banks > 0 {
+			h.Reset()
+		} else {
+			h.ResetDense()
+		}
+
+		if stats, _ := h.HashStats(); stats != (HashStats{}) {
+			t.Errorf("%+v: got stats %+v", c, stats)
+		}
+
+		// doesn't trip AssertMonotonic
+		h.Add([]byte("foo"))
+	}
+}
+
+func TestClone(t *testing.T) {
+	for _, c := range []Config{{}, {Banks: 2}, {TrackVolume: true, MinHashSize: 100, Debug: true}} {
+		for _, count := range []uint64{100, 100000} {
+			h := MustNewWithConfig(c)
+			for i := uint64(0); i < count; i++ {
+				h.Add(intToBytes(i))
+			}
+
+			snapshot := h.Marshal()
+			clone := h.Clone()
+			if !hllpEqual(*h, *clone) {
+				t.Errorf("%+v, count %d: clone differs", c, count)
+			}
+
+			// adding to either doesn't affect the other
+			for i := uint64(0); i < 1000; i++ {
+				clone.Add(intToBytes(i + 1000000))
+			}
+			if !bytes.Equal(h.Marshal(), snapshot) {
+				t.Errorf("%+v, count %d: adding to the clone changed h", c, count)
+			}
+
+			snapshot = clone.Marshal()
+			for i := uint64(0); i < 1000; i++ {
+				h.Add(intToBytes(i + 2000000))
+			}
+			if !bytes.Equal(clone.Marshal(), snapshot) {
+				t.Errorf("%+v, count %d: adding to h changed the clone", c, count)
+			}
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	c := Config{Precision: 10, TrackVolume: true, MinHashSize: 100, Debug: true, AssertMonotonic: true}
+	h := MustNewWithConfig(c)
+
+	for _, count := range []uint64{100, 100000} {
+		for i := uint64(0); i < count; i++ {
+			h.Add(intToBytes(i + 1000000))
+		}
+		base, err := h.CheckpointMarshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h.Reset()
+		if h.Count() != 0 || !h.sparse || h.Validate() != nil {
+			t.Errorf("count %d: got count %d, sparse %v, %v", count, h.Count(), h.sparse, h.Validate())
+		}
+
+		// behaves like a new estimator
+		fresh := MustNewWithConfig(c)
+		for i := uint64(0); i < 1000; i++ {
+			h.Add(intToBytes(i))
+			fresh.Add(intToBytes(i))
+		}
+
+		if !bytes.Equal(h.Marshal(), fresh.Marshal()) || h.Count() != fresh.Count() {
+			t.Errorf("count %d: reset HLLPP differs from new HLLPP", count)
+		}
+
+		// the next checkpoint is all of h
+		data, err := h.CheckpointMarshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Replay(base, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Count() != h.Count() {
+			t.Errorf("count %d: replay after reset got %d, expected %d", count, got.Count(), h.Count())
+		}
+
+		stats, _ := h.HashStats()
+		freshStats, _ := fresh.HashStats()
+		if stats != freshStats {
+			t.Errorf("count %d: got stats %+v, expected %+v", count, stats, freshStats)
+		}
+
+		h.Reset()
+	}
+
+	// tmpSet's buffer is reused
+	h = New()
+	h.Add([]byte("foo"))
+	tmpSet := h.tmpSet
+	h.Reset()
+	h.Add([]byte("bar"))
+	if &h.tmpSet[0] != &tmpSet[0] {
+		t.Error("expected tmpSet to be reused")
+	}
+}
+
+func BenchmarkResetDense(b *testing.B) {
+	h := MustNewWithConfig(Config{StartDense: true})
+	for i := 0; i < b.N; i++ {
+		h.ResetDense()
+	}
+}
+
+func BenchmarkNewDense(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		MustNewWithConfig(Config{StartDense: true})
+	}
+}
+
+func TestSignificantlyDifferent(t *testing.T) {
+	newH := func(start, n uint64) *HLLPP {
+		h := New()
+		for i := start; i < start+n; i++ {
+			h.Add(intToBytes(i))
+		}
+		return h
+	}
+
+	for _, c := range []struct {
+		a, b     *HLLPP
+		expected bool
+	}{
+		{newH(0, 100000), newH(1000000, 100500), false},
+		{newH(0, 100000), newH(1000000, 150000), true},
+		{newH(0, 1000), newH(1000000, 1001), false},
+		{newH(0, 1000), newH(1000000, 1200), true},
+	} {
+		got, err := c.a.SignificantlyDifferent(c.b, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.expected {
+			t.Errorf("%d vs %d: got %v, expected %v", c.a.Count(), c.b.Count(), got, c.expected)
+		}
+	}
+
+	other, _ := NewWithConfig(Config{Precision: 10})
+	if _, err := New().SignificantlyDifferent(other, 3); err == nil {
+		t.Error("expected error for different parameters")
+	}
+}
+
+func TestHashStats(t *testing.T) {
+	if _, err := New().HashStats(); err == nil {
+		t.Error("expected error without Debug")
+	}
+
+	uniform := MustNewWithConfig(Config{Debug: true})
+	skewed := MustNewWithConfig(Config{Debug: true})
+
+	var numSkewed int
+	for i := uint64(0); i < 80000; i++ {
+		v := intToBytes(i)
+		uniform.Add(v)
+
+		// only values whose hash is in the bottom quarter
+		if murmurSum64(v)>>62 == 0 {
+			skewed.Add(v)
+			numSkewed++
+		}
+	}
+
+	stats, err := uniform.HashStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Count != 80000 || stats.Min >= 1<<50 || stats.Max <= math.MaxUint64-1<<50 {
+		t.Errorf("got %+v", stats)
+	}
+
+	for i, n := range stats.Histogram {
+		if n < 9000 || n > 11000 {
+			t.Errorf("uniform bucket %d: got %d", i, n)
+		}
+	}
+
+	stats, err = skewed.HashStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Count != uint64(numSkewed) || stats.Max >= 1<<62 {
+		t.Errorf("got %+v", stats)
+	}
+
+	for i, n := range stats.Histogram {
+		if i < 2 && n < 9000 || i >= 2 && n != 0 {
+			t.Errorf("skewed bucket %d: got %d", i, n)
+		}
+	}
+}
+
+func TestWeightedAverageCount(t *testing.T) {
+	var sketches []*HLLPP
+	for _, n := range []uint64{10, 20, 60} {
+		h := New()
+		for i := uint64(0); i < n; i++ {
+			h.Add(intToBytes(i))
+		}
+		if h.Count() != n {
+			t.Fatalf("got %d, expected %d", h.Count(), n)
+		}
+		sketches = append(sketches, h)
+	}
+
+	got, err := WeightedAverageCount(sketches, []float64{1, 2, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 27.5 {
+		t.Errorf("got %f, expected 27.5", got)
+	}
+
+	for _, weights := range [][]float64{
+		{1, 2},
+		{1, -1, 1},
+		{0, 0, 0},
+		{1, math.NaN(), 1},
+	} {
+		if _, err := WeightedAverageCount(sketches, weights); err == nil {
+			t.Errorf("%v: expected error", weights)
+		}
+	}
+}
+
+func TestExportDense8(t *testing.T) {
+	h := New()
+	for _, count := range []uint64{100, 100000} {
+		for i := uint64(0); i < count; i++ {
+			h.Add(intToBytes(i))
+		}
+		wasSparse := h.sparse
+
+		exported := h.ExportDense8()
+		if len(exported) != 1<<14 {
+			t.Fatalf("got length %d", len(exported))
+		}
+
+		if h.sparse != wasSparse {
+			t.Error("h changed representation")
+		}
+
+		dense := h.clone()
+		dense.flushTmpSet()
+		dense.toNormal()
+		for i, r := range exported {
+			if exp := getRegister(dense.data, dense.bitsPerRegister, uint32(i)); r != exp {
+				t.Fatalf("count %d, register %d: got %d, expected %d", count, i, r, exp)
+			}
+		}
+	}
+}
+
+func TestMergeWithOverlap(t *testing.T) {
+	for _, n := range []uint64{1000, 100000} {
+		h, other := New(), New()
+		for i := uint64(0); i < n; i++ {
+			h.Add(intToBytes(i))
+			other.Add(intToBytes(i + n/2))
+		}
+
+		overlap, err := h.MergeWithOverlap(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e := estimateError(overlap, n/2); e > 0.1 {
+			t.Errorf("n=%d: got overlap %d, expected %d (%f)", n, overlap, n/2, e)
+		}
+
+		if e := estimateError(h.Count(), n+n/2); e > 0.02 {
+			t.Errorf("n=%d: got %d, expected %d (%f)", n, h.Count(), n+n/2, e)
+		}
+	}
+
+	// disjoint clamps to 0 rather than going negative
+	h, other := New(), New()
+	h.Add([]byte("foo"))
+	other.Add([]byte("bar"))
+	if overlap, err := h.MergeWithOverlap(other); err != nil || overlap != 0 {
+		t.Errorf("got %d, %v", overlap, err)
+	}
+}
+
+func TestMergeWithModeChange(t *testing.T) {
+	h, other := New(), New()
+	h.Add([]byte("foo"))
+	other.Add([]byte("bar"))
+
+	// sparse into sparse
+	if changed, err := h.MergeWithModeChange(other); err != nil || changed || !h.sparse {
+		t.Errorf("got %v, %v", changed, err)
+	}
+
+	dense := New()
+	for i := uint64(0); i < 100000; i++ {
+		dense.Add(intToBytes(i))
+	}
+
+	if changed, err := h.MergeWithModeChange(dense); err != nil || !changed || h.sparse {
+		t.Errorf("got %v, %v", changed, err)
+	}
+
+	// already dense
+	if changed, err := h.MergeWithModeChange(other); err != nil || changed {
+		t.Errorf("got %v, %v", changed, err)
+	}
+
+	if _, err := h.MergeWithModeChange(MustNewWithConfig(Config{Precision: 12})); err == nil {
+		t.Error("expected error for different parameters")
+	}
+}
+
+func TestAddUint32(t *testing.T) {
+	for _, n := range []uint64{100, 10000, 200000} {
+		h, other := New(), New()
+		for i := uint64(0); i < n; i++ {
+			h.AddUint32(uint32(i))
+			other.AddUint32(uint32(i + n/2))
+		}
+
+		if e := estimateError(h.Count(), n); e > 0.02 {
+			t.Errorf("Got %d, expected %d (%f)", h.Count(), n, e)
+		}
+
+		if err := h.Merge(other); err != nil {
+			t.Fatal(err)
+		}
+
+		if e := estimateError(h.Count(), n+n/2); e > 0.02 {
+			t.Errorf("merged: Got %d, expected %d (%f)", h.Count(), n+n/2, e)
+		}
+	}
+}
+
+func TestAddUint32Zero(t *testing.T) {
+	// ID 0 must not hash to all zeros, which saturates a register
+	h := MustNewWithConfig(Config{StartDense: true})
+	h.AddUint32(0)
+	if count, _ := h.SaturatedRegisters(); count != 0 {
+		t.Errorf("got %d saturated registers", count)
+	}
+	if got := h.Count(); got != 1 {
+		t.Errorf("got count %d, expected 1", got)
+	}
+}
+
+func BenchmarkAddUint32(b *testing.B) {
+	h := New()
+	for i := 0; i < b.N; i++ {
+		h.AddUint32(uint32(i))
+	}
+}
+
+func BenchmarkAddUint32Bytes(b *testing.B) {
+	h := New()
+	var buf [4]byte
+	for i := 0; i < b.N; i++ {
+		binary.BigEndian.PutUint32(buf[:], uint32(i))
+		h.Add(buf[:])
+	}
+}
+
+func TestAddUint64(t *testing.T) {
+	for _, n := range []uint64{100, 100000} {
+		h, exp := New(), New()
+		for i := uint64(0); i < n; i++ {
+			h.AddUint64(murmurSum64(intToBytes(i)))
+			exp.Add(intToBytes(i))
+		}
+
+		if !hllpEqual(*h, *exp) {
+			t.Errorf("n=%d: AddUint64 of Add's hashes differs from Add", n)
+		}
+	}
+
+	// hashes from elsewhere
+	rng := rand.New(rand.NewSource(1))
+	h := New()
+	for i := 0; i < 100000; i++ {
+		h.AddUint64(rng.Uint64())
+	}
+	if e := estimateError(h.Count(), 100000); e > 0.02 {
+		t.Errorf("Got %d, expected %d (%f)", h.Count(), 100000, e)
+	}
+}
+
+func TestAddString(t *testing.T) {
+	h, exp := New(), New()
+	for i := 0; i < 100000; i++ {
+		h.AddString(strconv.Itoa(i))
+		exp.Add([]byte(strconv.Itoa(i)))
+	}
+	h.AddString("")
+	exp.Add(nil)
+
+	if !hllpEqual(*h, *exp) {
+		t.Error("AddString differs from Add")
+	}
+
+	// dense, so adding doesn't append to tmpSet
+	s := strings.Repeat("x", 100)
+	if allocs := testing.AllocsPerRun(100, func() { h.AddString(s) }); allocs != 0 {
+		t.Errorf("got %f allocs", allocs)
+	}
+}
+
+func BenchmarkAddString(b *testing.B) {
+	h := New()
+	s := strings.Repeat("x", 100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.AddString(s)
+	}
+}
+
+func BenchmarkAddStringBytes(b *testing.B) {
+	h := New()
+	s := strings.Repeat("x", 100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.Add([]byte(s))
+	}
+}
+
+func TestAutoFlushEvery(t *testing.T) {
+	h := MustNewWithConfig(Config{AutoFlushEvery: 10})
+	plain := New()
+
+	for i := uint64(0); h.sparse; i++ {
+		h.Add(intToBytes(i))
+		plain.Add(intToBytes(i))
+
+		if len(h.tmpSet) >= 10 {
+			t.Fatalf("%d: tmpSet has %d values", i, len(h.tmpSet))
+		}
+
+		if i%1000 == 0 && h.Count() != plain.Count() {
+			t.Fatalf("%d: got %d, expected %d", i, h.Count(), plain.Count())
+		}
+	}
+
+	if _, err := NewWithConfig(Config{AutoFlushEvery: -1}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestIntersectionCountMinHash(t *testing.T) {
+	newPair := func(minHashSize int, n, overlap, offset uint64) (*HLLPP, *HLLPP) {
+		c := Config{MinHashSize: minHashSize}
+		a, b := MustNewWithConfig(c), MustNewWithConfig(c)
+		for i := uint64(0); i < n; i++ {
+			a.Add(intToBytes(offset + i))
+			b.Add(intToBytes(offset + n - overlap + i))
+		}
+		return a, b
+	}
+
+	// small intersections of big sets
+	var ieErr, mhErr float64
+	for trial := uint64(0); trial < 5; trial++ {
+		offset := trial * 10000000
+
+		a, b := newPair(0, 100000, 2000, offset)
+		ie, err := a.IntersectionCount(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ieErr += math.Abs(float64(ie) - 2000)
+
+		a, b = newPair(4096, 100000, 2000, offset)
+		mh, err := a.IntersectionCount(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mhErr += math.Abs(float64(mh) - 2000)
+
+		if e := estimateError(mh, 2000); e > 0.5 {
+			t.Errorf("trial %d: got %d, expected 2000 (%f)", trial, mh, e)
+		}
+	}
+
+	if mhErr >= ieErr {
+		t.Errorf("MinHash error %f not better than inclusion-exclusion error %f", mhErr/5, ieErr/5)
+	}
+
+	// exact when everything fits in the MinHash
+	a, b := newPair(1024, 500, 123, 0)
+	if got, err := a.IntersectionCount(b); err != nil || got != 123 {
+		t.Errorf("got %d, %v", got, err)
+	}
+
+	// merging keeps the MinHash of the union
+	merged := a.clone()
+	if err := merged.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.minHash) != 877 {
+		t.Errorf("got %d hashes, expected 877", len(merged.minHash))
+	}
+
+	// so does MergeTagged
+	tagged := MustNewWithConfig(Config{MinHashSize: 1024})
+	if err := tagged.MergeTagged(a, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := tagged.IntersectionCount(b); err != nil || got != 123 {
+		t.Errorf("tagged: got %d, %v", got, err)
+	}
+	if err := tagged.MergeTagged(b, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(tagged.minHash) != 877 {
+		t.Errorf("tagged: got %d hashes, expected 877", len(tagged.minHash))
+	}
+
+	// but not if other doesn't have one
+	if err := merged.Merge(New()); err != nil {
+		t.Fatal(err)
+	}
+	if merged.minHashK != 0 || merged.minHash != nil {
+		t.Error("expected MinHash to be dropped")
+	}
+
+	if _, err := NewWithConfig(Config{MinHashSize: 1 << 16}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestAddAll(t *testing.T) {
+	ch := make(chan []byte, 10)
+	go func() {
+		for i := uint64(0); i < 1000; i++ {
+			ch <- intToBytes(i)
+		}
+		close(ch)
+	}()
+
+	h := New()
+	h.AddAll(ch)
+	if h.Count() != 1000 {
+		t.Errorf("got %d, expected 1000", h.Count())
+	}
+
+	ch = make(chan []byte, 10)
+	go func() {
+		for i := uint64(0); i < 1000; i++ {
+			ch <- intToBytes(i)
+		}
+		close(ch)
+	}()
+
+	h = New()
+	if err := h.AddAllContext(context.Background(), ch); err != nil {
+		t.Fatal(err)
+	}
+	if h.Count() != 1000 {
+		t.Errorf("got %d, expected 1000", h.Count())
+	}
+
+	// cancel partway through a channel that is never closed
+	ctx, cancel := context.WithCancel(context.Background())
+	ch = make(chan []byte)
+	go func() {
+		for i := uint64(0); i < 100; i++ {
+			ch <- intToBytes(i)
+		}
+		cancel()
+	}()
+
+	h = New()
+	if err := h.AddAllContext(ctx, ch); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if h.Count() != 100 {
+		t.Errorf("got %d, expected 100", h.Count())
+	}
+}
+
+func TestPortableLog(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		x := math.Ldexp(1+rng.Float64(), rng.Intn(60)-10)
+		got, exp := portableLog(x), math.Log(x)
+		if math.Abs(got-exp) > 4e-16*math.Max(1, math.Abs(exp)) {
+			t.Fatalf("log(%v): got %v, expected %v", x, got, exp)
+		}
+	}
+
+	if got := portableLog(1); got != 0 {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestDeterministicCount(t *testing.T) {
+	// These must hold on every architecture.
+	for _, c := range []struct {
+		p, pp uint8
+		n     uint64
+		count uint64
+	}{
+		{14, 20, 1000, 1000},
+		{14, 20, 5000, 5003},
+		{14, 20, 20000, 20030},
+		{14, 20, 1000000, 992165},
+		{10, 25, 300, 304},
+		{10, 25, 3000, 2919},
+		{16, 16, 50000, 50149},
+	} {
+		h := MustNewWithConfig(Config{Precision: c.p, SparsePrecision: c.pp, DeterministicCount: true})
+		for i := uint64(0); i < c.n; i++ {
+			h.Add(intToBytes(i))
+		}
+
+		if got := h.Count(); got != c.count {
+			t.Errorf("p=%d, p'=%d, n=%d: got %d, expected %d", c.p, c.pp, c.n, got, c.count)
+		}
+	}
+}
+
+func TestNewFromParts(t *testing.T) {
+	h, err := NewWithConfig(Config{Precision: 12, SparsePrecision: 22})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, count := range []uint64{0, 100, 100000} {
+		for i := uint64(0); i < count; i++ {
+			h.Add(intToBytes(i))
+		}
+
+		data := h.Data()
+		uh, err := NewFromParts(h.Precision(), h.SparsePrecision(), h.IsSparse(), h.BitsPerRegister(), data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if uh.sparse != h.sparse || !bytes.Equal(uh.data, h.data) || uh.Count() != h.Count() {
+			t.Errorf("count %d: got count %d, expected %d", count, uh.Count(), h.Count())
+		}
+
+		if h.sparse && uh.sparseLength != h.sparseLength {
+			t.Errorf("count %d: got sparse length %d, expected %d", count, uh.sparseLength, h.sparseLength)
+		}
+
+		if len(data) > 0 && &data[0] == &h.data[0] {
+			t.Error("expected a copy")
+		}
+	}
+
+	if _, err := NewFromParts(14, 20, true, 5, nil); err == nil {
+		t.Error("expected error for sparse with bits per register")
+	}
+
+	if _, err := NewFromParts(14, 20, false, 5, make([]byte, 10)); err == nil {
+		t.Error("expected error for short dense data")
+	}
+
+	if _, err := NewFromParts(14, 20, true, 0, []byte{0x80}); err == nil {
+		t.Error("expected error for truncated varint")
+	}
+}
+
+func TestAssertMonotonic(t *testing.T) {
+	c := Config{Precision: 10, AssertMonotonic: true}
+
+	// sparse, converting to dense, merging
+	h := MustNewWithConfig(c)
+	for i := uint64(0); i < 5000; i++ {
+		h.Add(intToBytes(i))
+		if i%1000 == 0 {
+			other := MustNewWithConfig(c)
+			other.Add(intToBytes(i + 1000000))
+			if err := h.Merge(other); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if h.sparse {
+		t.Fatal("expected dense")
+	}
+
+	// resetting starts over rather than tripping the check
+	for _, reset := range []func(){h.Reset, h.ResetDense} {
+		other := h.clone()
+		reset()
+		h.Add([]byte("foo"))
+		if err := h.Merge(other); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// simulate corruption
+	for i := uint32(0); i < 10; i++ {
+		setRegister(h.data, h.bitsPerRegister, i, 0)
+	}
+
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "registers decreased") {
+			t.Errorf("expected panic, got %v", r)
+		}
+	}()
+	h.Add([]byte("foo"))
+	t.Error("expected panic")
+}
@@ -4,8 +4,13 @@
 package hllpp
 
 import (
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 /*
@@ -23,38 +28,127 @@ Here is a diagram of the marshal format:
    |       ...sparseLength         |bitsPerRegister|    Data...    |
    +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 
+If the compact dense flag is set (version 2 only), Data is a list of 3 byte
+entries instead of the packed registers, one per non-zero register:
+
+    0               1               2
+    0 1 2 3 4 5 6 7 0 1 2 3 4 5 6 7 0 1 2 3 4 5 6 7
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |        Register Index         |     Value     |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+If the volume flag is set (version 2 only), Data is followed by m 2 byte
+volume counters (see Config.TrackVolume).
+
+If the MinHash flag is set (version 2 only), the MinHash hashes (see
+Config.MinHashSize) come last, as n 8 byte hashes followed by n and k:
+
+    0               1               2               3
+    0 1 2 3 4 5 6 7 0 1 2 3 4 5 6 7 0 1 2 3 4 5 6 7 0 1 2 3 4 5 6 7
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |                    Hashes (n * 8 bytes)...                    |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |               n               |               k               |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
 */
 
 const (
 	marshalVersion    = 1
 	marshalHeaderSize = 15
 
-	marshalFlagSparse = 1
+	// version used when a flag older versions don't understand is set
+	marshalVersionExtended = 2
+
+	marshalFlagSparse       = 1
+	marshalFlagCompactDense = 2
+	marshalFlagVolume       = 4
+	marshalFlagMinHash      = 8
+	marshalFlagBanks        = 32
+
+	// set on data from CheckpointMarshal that only holds changes since the
+	// previous checkpoint
+	marshalFlagCheckpointDelta = 16
+
+	// every flag version 2 knows about
+	marshalFlagsExtended = marshalFlagSparse | marshalFlagCompactDense | marshalFlagVolume |
+		marshalFlagMinHash | marshalFlagCheckpointDelta | marshalFlagBanks
 )
 
 // Marshal serializes h into a byte slice that can be deserialized via
 // Unmarshal. The data is naturally compressed, so don't bother trying
-// to compress it any more.
+// to compress it any more. Volume counters (see Config.TrackVolume), MinHash
+// sketches (see Config.MinHashSize) and banks (see Config.Banks) use marshal
+// version 2, which older versions of this package can't unmarshal.
+// Data marshaled by any earlier version of this package can still be
+// unmarshaled.
 func (h *HLLPP) Marshal() []byte {
+	return h.marshal(false)
+}
+
+// MarshalCompact is like Marshal, but stores dense estimators with few
+// non-zero registers as a list of the non-zero registers, which is smaller
+// but uses marshal version 2.
+func (h *HLLPP) MarshalCompact() []byte {
+	return h.marshal(true)
+}
+
+func (h *HLLPP) marshal(compact bool) []byte {
 	if h.sparse {
 		h.flushTmpSet()
 	}
 
-	buf := make([]byte, marshalHeaderSize+len(h.data))
+	version := uint16(marshalVersion)
+
+	var flags uint16
+	if h.sparse {
+		flags |= marshalFlagSparse
+	}
+
+	data := h.data
+	if compact && !h.sparse {
+		if compact := h.compactDense(); compact != nil {
+			version = marshalVersionExtended
+			flags |= marshalFlagCompactDense
+			data = compact
+		}
+	}
+
+	if h.volume != nil {
+		version = marshalVersionExtended
+		flags |= marshalFlagVolume
+
+		data = append([]byte(nil), data...)
+		for _, v := range h.volume {
+			data = append(data, byte(v>>8), byte(v))
+		}
+	}
+
+	if h.minHashK > 0 {
+		version = marshalVersionExtended
+		flags |= marshalFlagMinHash
+
+		// the full slice expression makes append copy rather than write
+		// past the end of h.data
+		data = appendMinHash(data[:len(data):len(data)], h.minHashK, h.minHash)
+	}
+
+	if h.banks != nil {
+		version = marshalVersionExtended
+		flags |= marshalFlagBanks
+		data = appendBanks(data[:len(data):len(data)], h.banks)
+	}
+
+	buf := make([]byte, marshalHeaderSize+len(data))
 
 	offset := 0
 
-	binary.BigEndian.PutUint16(buf[offset:], marshalVersion)
+	binary.BigEndian.PutUint16(buf[offset:], version)
 	offset += 2
 
 	binary.BigEndian.PutUint32(buf[offset:], uint32(len(buf)))
 	offset += 4
 
-	var flags uint16
-	if h.sparse {
-		flags |= marshalFlagSparse
-	}
-
 	binary.BigEndian.PutUint16(buf[offset:], flags)
 	offset += 2
 
@@ -70,58 +164,217 @@ func (h *HLLPP) Marshal() []byte {
 	buf[offset] = byte(h.bitsPerRegister)
 	offset += 1
 
-	copy(buf[offset:], h.data)
+	copy(buf[offset:], data)
 
 	return buf
 }
 
+// MarshalFolded is like Marshal, but marshals h as if it had been folded down
+// to precision targetP (see Config.DowngradeOnMerge), which makes the result
+// smaller at the cost of accuracy. h itself is not modified. Unmarshal returns
+// a normal estimator with p=targetP. targetP must be in the range [4..p].
+func (h *HLLPP) MarshalFolded(targetP uint8) ([]byte, error) {
+	if targetP < 4 || targetP > h.p {
+		return nil, fmt.Errorf("invalid target precision %d for p=%d", targetP, h.p)
+	}
+
+	folded := h.clone()
+	folded.fold(targetP)
+	return folded.Marshal(), nil
+}
+
+// compactDense returns h's non-zero registers as index/value entries, or nil
+// if that wouldn't be smaller than the packed registers.
+func (h *HLLPP) compactDense() []byte {
+	var numSet int
+	for i := uint32(0); i < h.m; i++ {
+		if getRegister(h.data, h.bitsPerRegister, i) > 0 {
+			numSet++
+		}
+	}
+
+	if 3*numSet >= len(h.data) {
+		return nil
+	}
+
+	compact := make([]byte, 0, 3*numSet)
+	for i := uint32(0); i < h.m; i++ {
+		if reg := getRegister(h.data, h.bitsPerRegister, i); reg > 0 {
+			compact = append(compact, byte(i>>8), byte(i), reg)
+		}
+	}
+	return compact
+}
+
 // Unmarshal deserializes a byte slice returned by Marshal back into an
-// HLLPP object.
+// HLLPP object. Sparse data that is too big is converted to dense (see
+// NormalizeRepresentation). Deltas returned by CheckpointMarshal only hold
+// part of an estimator, so they are rejected (see Replay).
 func Unmarshal(data []byte) (*HLLPP, error) {
-	if len(data) < marshalHeaderSize {
+	if len(data) < 2 {
 		return nil, fmt.Errorf("data too short (%d bytes)", len(data))
 	}
 
-	offset := 0
+	version := binary.BigEndian.Uint16(data)
 
-	version := binary.BigEndian.Uint16(data[offset:])
-	offset += 2
+	unmarshal, ok := unmarshalers[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrVersionMismatch, version)
+	}
 
-	if version != marshalVersion {
-		return nil, fmt.Errorf("unknown version: %d", version)
+	h, err := unmarshal(data)
+	if err != nil {
+		return nil, err
 	}
 
-	length := binary.BigEndian.Uint32(data[offset:])
-	offset += 4
+	h.NormalizeRepresentation()
+	return h, nil
+}
 
-	if int(length) != len(data) {
-		return nil, fmt.Errorf("length mismatch: header says %d, was %d", length, len(data))
+// UnmarshalBatch unmarshals each of blobs (see Unmarshal). It stops at the
+// first error, which includes the index of the bad blob.
+func UnmarshalBatch(blobs [][]byte) ([]*HLLPP, error) {
+	hs := make([]*HLLPP, len(blobs))
+	for i, data := range blobs {
+		h, err := Unmarshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("blob %d: %w", i, err)
+		}
+		hs[i] = h
 	}
+	return hs, nil
+}
 
-	flags := binary.BigEndian.Uint16(data[offset:])
-	offset += 2
+// CountFromMarshaled returns the same value as Unmarshal(data).Count(), but
+// computes it directly from data without copying or decoding the registers
+// (unless data has banks, see Config.Banks, or sparse data that Unmarshal
+// would convert to dense, see NormalizeRepresentation).
+func CountFromMarshaled(data []byte) (uint64, error) {
+	if len(data) < 2 {
+		return 0, fmt.Errorf("data too short (%d bytes)", len(data))
+	}
+
+	version := binary.BigEndian.Uint16(data)
+	if _, ok := unmarshalers[version]; !ok {
+		return 0, fmt.Errorf("%w: %d", ErrVersionMismatch, version)
+	}
 
-	p := data[offset]
-	offset++
+	h, flags, offset, err := unmarshalHeader(data)
+	if err != nil {
+		return 0, err
+	}
 
-	pp := data[offset]
-	offset++
+	// the estimate is the average over all the banks
+	if version >= marshalVersionExtended && flags&marshalFlagBanks > 0 {
+		h, err := Unmarshal(data)
+		if err != nil {
+			return 0, err
+		}
+		return h.Count(), nil
+	}
 
-	h, err := NewWithConfig(Config{
-		Precision:       p,
-		SparsePrecision: pp,
-	})
+	payload, err := skipTrailers(h, version, flags, data[offset:])
+	if err != nil {
+		return 0, err
+	}
+
+	if h.sparse {
+		h.data = payload
+		if h.sparseTooBig() {
+			h, err := Unmarshal(data)
+			if err != nil {
+				return 0, err
+			}
+			return h.Count(), nil
+		}
+
+		if h.sparseLength >= h.mp {
+			return 0, fmt.Errorf("invalid sparse length: %d", h.sparseLength)
+		}
+		if !h.rawEstimateOnly {
+			return h.linearCounting(h.mp, h.mp-h.sparseLength), nil
+		}
+	}
+
+	if version >= marshalVersionExtended && flags&marshalFlagCompactDense > 0 {
+		compact := payload
+		if len(compact)%3 != 0 || uint32(len(compact)/3) > h.m {
+			return 0, fmt.Errorf("invalid compact dense length: %d", len(compact))
+		}
+
+		numSet := uint32(len(compact) / 3)
+		sum := float64(h.m - numSet)
+		for i := 2; i < len(compact); i += 3 {
+			sum += 1.0 / float64(uint64(1)<<compact[i])
+		}
+		return h.estimate(sum, h.m-numSet), nil
+	}
+
+	h.data = payload
+	if uint32(len(h.data)) != h.m*h.bitsPerRegister/8 {
+		return 0, fmt.Errorf("invalid dense length: %d", len(h.data))
+	}
+
+	return h.estimate(h.registerSum()), nil
+}
+
+// SparseEntriesFromMarshaled returns the distinct p' indexes in data (as
+// returned by Marshal) in ascending order, like SparseIndexes, by decoding the
+// sparse data in place rather than unmarshaling it. It returns an error if
+// data is dense or the sparse data is corrupt.
+func SparseEntriesFromMarshaled(data []byte) ([]uint32, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("data too short (%d bytes)", len(data))
+	}
+
+	version := binary.BigEndian.Uint16(data)
+	if _, ok := unmarshalers[version]; !ok {
+		return nil, fmt.Errorf("%w: %d", ErrVersionMismatch, version)
+	}
+
+	h, flags, offset, err := unmarshalHeader(data)
 	if err != nil {
 		return nil, err
 	}
 
-	h.sparse = flags&marshalFlagSparse > 0
+	if !h.sparse {
+		return nil, errors.New("data is dense")
+	}
 
-	h.sparseLength = binary.BigEndian.Uint32(data[offset:])
-	offset += 4
+	payload, err := skipTrailers(h, version, flags, data[offset:])
+	if err != nil {
+		return nil, err
+	}
 
-	h.bitsPerRegister = uint32(data[offset])
-	offset++
+	length, err := sparseDataLength(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := make([]uint32, 0, length)
+	reader := sparseReader{data: payload}
+	for !reader.Done() {
+		indexes = append(indexes, h.getIndex(reader.Next(), h.pp))
+	}
+	return indexes, nil
+}
+
+// ErrVersionMismatch is returned by Unmarshal when the data has a marshal
+// version this package doesn't know how to read.
+var ErrVersionMismatch = errors.New("unknown version")
+
+// unmarshalers maps each supported marshal version to the function that
+// deserializes it. The data passed in still includes the version.
+var unmarshalers = map[uint16]func([]byte) (*HLLPP, error){
+	1: unmarshalV1,
+	2: unmarshalV2,
+}
+
+func unmarshalV1(data []byte) (*HLLPP, error) {
+	h, _, offset, err := unmarshalHeader(data)
+	if err != nil {
+		return nil, err
+	}
 
 	if len(data) > offset {
 		h.data = make([]byte, len(data)-offset)
@@ -130,3 +383,402 @@ func Unmarshal(data []byte) (*HLLPP, error) {
 
 	return h, nil
 }
+
+// unmarshalV2 is the same as version 1, but with the compact dense, volume,
+// MinHash and banks flags.
+func unmarshalV2(data []byte) (*HLLPP, error) {
+	h, flags, offset, err := unmarshalHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := data[offset:]
+
+	if flags&marshalFlagBanks > 0 {
+		banks, err := splitBanks(h, &payload)
+		if err != nil {
+			return nil, err
+		}
+		h.banks = banks
+	}
+
+	if flags&marshalFlagMinHash > 0 {
+		k, hashes, err := splitMinHash(&payload)
+		if err != nil {
+			return nil, err
+		}
+		h.minHashK, h.minHash = k, hashes
+	}
+
+	if flags&marshalFlagVolume > 0 {
+		volume, err := splitVolume(h, &payload)
+		if err != nil {
+			return nil, err
+		}
+		h.volume = volume
+	}
+
+	if flags&marshalFlagCompactDense == 0 {
+		if len(payload) > 0 {
+			h.data = make([]byte, len(payload))
+			copy(h.data, payload)
+		}
+		return h, nil
+	}
+
+	if h.sparse {
+		return nil, errors.New("sparse data can't be compact dense")
+	}
+
+	compact := payload
+	if len(compact)%3 != 0 {
+		return nil, fmt.Errorf("invalid compact dense length: %d", len(compact))
+	}
+
+	h.data = make([]byte, h.m*h.bitsPerRegister/8)
+	for i := 0; i < len(compact); i += 3 {
+		idx, reg := uint32(compact[i])<<8|uint32(compact[i+1]), compact[i+2]
+		if idx >= h.m || reg >= 1<<h.bitsPerRegister {
+			return nil, fmt.Errorf("invalid compact dense register %d: %d", idx, reg)
+		}
+		setRegister(h.data, h.bitsPerRegister, idx, reg)
+	}
+
+	return h, nil
+}
+
+// marshalHeader holds the fields of the header shared by versions 1 and 2.
+type marshalHeader struct {
+	version         uint16
+	length          uint32
+	flags           uint16
+	p               uint8
+	pp              uint8
+	sparseLength    uint32
+	bitsPerRegister uint8
+}
+
+// parseHeader reads the header fields from data without validating them.
+func parseHeader(data []byte) (hdr marshalHeader, _ error) {
+	if len(data) < marshalHeaderSize {
+		return hdr, fmt.Errorf("data too short (%d bytes)", len(data))
+	}
+
+	hdr.version = binary.BigEndian.Uint16(data[0:])
+	hdr.length = binary.BigEndian.Uint32(data[2:])
+	hdr.flags = binary.BigEndian.Uint16(data[6:])
+	hdr.p = data[8]
+	hdr.pp = data[9]
+	hdr.sparseLength = binary.BigEndian.Uint32(data[10:])
+	hdr.bitsPerRegister = data[14]
+
+	return hdr, nil
+}
+
+// splitVolume decodes the volume counters at the end of payload, and removes
+// them from payload.
+func splitVolume(h *HLLPP, payload *[]byte) ([]uint16, error) {
+	n := int(2 * h.m)
+	if len(*payload) < n {
+		return nil, fmt.Errorf("data too short for volume (%d bytes)", len(*payload))
+	}
+
+	encoded := (*payload)[len(*payload)-n:]
+	*payload = (*payload)[:len(*payload)-n]
+
+	volume := make([]uint16, h.m)
+	for i := range volume {
+		volume[i] = binary.BigEndian.Uint16(encoded[2*i:])
+	}
+	return volume, nil
+}
+
+// appendBanks appends the banks (see Config.Banks), each marshaled, followed
+// by their total size as a uint32 and their number as a uint16.
+func appendBanks(data []byte, banks []*HLLPP) []byte {
+	var size int
+	for _, bank := range banks {
+		bankData := bank.Marshal()
+		data = append(data, bankData...)
+		size += len(bankData)
+	}
+	return append(data, byte(size>>24), byte(size>>16), byte(size>>8), byte(size), byte(len(banks)>>8), byte(len(banks)))
+}
+
+// splitBanks decodes the banks at the end of payload, and removes them from
+// payload. The banks must be dense, with the same parameters as h.
+func splitBanks(h *HLLPP, payload *[]byte) ([]*HLLPP, error) {
+	if len(*payload) < 6 {
+		return nil, fmt.Errorf("data too short for banks (%d bytes)", len(*payload))
+	}
+
+	trailer := (*payload)[len(*payload)-6:]
+	size, n := int(binary.BigEndian.Uint32(trailer)), int(binary.BigEndian.Uint16(trailer[4:]))
+	if n != 1 && n != 3 && n != 7 {
+		return nil, fmt.Errorf("invalid number of banks: %d", n+1)
+	}
+	if h.p >= uint8(64/(n+1)) {
+		return nil, fmt.Errorf("precision %d too big for %d banks", h.p, n+1)
+	}
+
+	if size < 0 || len(*payload) < 6+size {
+		return nil, fmt.Errorf("data too short for banks (%d bytes)", len(*payload))
+	}
+
+	encoded := (*payload)[len(*payload)-6-size : len(*payload)-6]
+	*payload = (*payload)[:len(*payload)-6-size]
+
+	banks := make([]*HLLPP, n)
+	for i := range banks {
+		hdr, err := parseHeader(encoded)
+		if err != nil || int(hdr.length) > len(encoded) {
+			return nil, fmt.Errorf("bank %d: invalid length", i+1)
+		}
+		if hdr.version != marshalVersion && hdr.version != marshalVersionExtended {
+			return nil, fmt.Errorf("bank %d: %w: %d", i+1, ErrVersionMismatch, hdr.version)
+		}
+
+		// unmarshalV2 also reads version 1, which is version 2 without the
+		// new flags (calling Unmarshal here would be an initialization cycle)
+		bank, err := unmarshalV2(encoded[:hdr.length])
+		if err != nil {
+			return nil, fmt.Errorf("bank %d: %w", i+1, err)
+		}
+		if bank.sparse || bank.banks != nil || bank.p != h.p || bank.pp != h.pp {
+			return nil, fmt.Errorf("bank %d: invalid bank", i+1)
+		}
+
+		banks[i] = bank
+		encoded = encoded[hdr.length:]
+	}
+
+	if len(encoded) > 0 {
+		return nil, fmt.Errorf("%d extra bytes after banks", len(encoded))
+	}
+
+	return banks, nil
+}
+
+// skipTrailers returns payload without the banks, MinHash and volume counters
+// that can follow the data in version 2, for callers that only need the data.
+func skipTrailers(h *HLLPP, version, flags uint16, payload []byte) ([]byte, error) {
+	if version < marshalVersionExtended {
+		return payload, nil
+	}
+
+	if flags&marshalFlagBanks > 0 {
+		if _, err := splitBanks(h, &payload); err != nil {
+			return nil, err
+		}
+	}
+
+	if flags&marshalFlagMinHash > 0 {
+		if _, _, err := splitMinHash(&payload); err != nil {
+			return nil, err
+		}
+	}
+
+	if flags&marshalFlagVolume > 0 {
+		n := int(2 * h.m)
+		if len(payload) < n {
+			return nil, fmt.Errorf("data too short for volume (%d bytes)", len(payload))
+		}
+		payload = payload[:len(payload)-n]
+	}
+
+	return payload, nil
+}
+
+// unmarshalHeader parses the header shared by versions 1 and 2, returning the
+// estimator (without data), the flags, and the offset of the data.
+func unmarshalHeader(data []byte) (_ *HLLPP, flags uint16, offset int, _ error) {
+	hdr, err := parseHeader(data)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	if int(hdr.length) != len(data) {
+		return nil, 0, 0, fmt.Errorf("length mismatch: header says %d, was %d", hdr.length, len(data))
+	}
+
+	if hdr.version >= marshalVersionExtended {
+		if unknown := hdr.flags &^ marshalFlagsExtended; unknown != 0 {
+			return nil, 0, 0, fmt.Errorf("unknown flags: %#04x", unknown)
+		}
+		if hdr.flags&marshalFlagCheckpointDelta > 0 {
+			return nil, 0, 0, errors.New("data is a checkpoint delta (see Replay)")
+		}
+	}
+
+	h, err := NewWithConfig(Config{
+		Precision:       hdr.p,
+		SparsePrecision: hdr.pp,
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	h.sparse = hdr.flags&marshalFlagSparse > 0
+	h.sparseLength = hdr.sparseLength
+	h.bitsPerRegister = uint32(hdr.bitsPerRegister)
+
+	if h.sparse && h.bitsPerRegister != 0 {
+		return nil, 0, 0, fmt.Errorf("sparse data with %d bits per register", h.bitsPerRegister)
+	}
+
+	if !h.sparse && h.bitsPerRegister != 5 && h.bitsPerRegister != 6 {
+		return nil, 0, 0, fmt.Errorf("dense data with %d bits per register", h.bitsPerRegister)
+	}
+
+	return h, hdr.flags, marshalHeaderSize, nil
+}
+
+// DebugHeader returns a multi-line human readable description of every field
+// in the header of data (as returned by Marshal), including each field's raw
+// bytes. The fields aren't validated, so this can be used to inspect corrupt
+// data, but the version must be known.
+func DebugHeader(data []byte) (string, error) {
+	hdr, err := parseHeader(data)
+	if err != nil {
+		return "", err
+	}
+
+	if hdr.version != marshalVersion && hdr.version != marshalVersionExtended {
+		return "", fmt.Errorf("%w: %d", ErrVersionMismatch, hdr.version)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "version:         %d [% x]\n", hdr.version, data[0:2])
+	fmt.Fprintf(&b, "length:          %d [% x] (actual %d)\n", hdr.length, data[2:6], len(data))
+	fmt.Fprintf(&b, "flags:           %#04x [% x]\n", hdr.flags, data[6:8])
+	fmt.Fprintf(&b, "  sparse:        %v\n", hdr.flags&marshalFlagSparse > 0)
+	fmt.Fprintf(&b, "  compact dense: %v\n", hdr.flags&marshalFlagCompactDense > 0)
+	fmt.Fprintf(&b, "  volume:        %v\n", hdr.flags&marshalFlagVolume > 0)
+	fmt.Fprintf(&b, "  minhash:       %v\n", hdr.flags&marshalFlagMinHash > 0)
+	fmt.Fprintf(&b, "  banks:         %v\n", hdr.flags&marshalFlagBanks > 0)
+	fmt.Fprintf(&b, "  delta:         %v\n", hdr.flags&marshalFlagCheckpointDelta > 0)
+	fmt.Fprintf(&b, "p:               %d [% x]\n", hdr.p, data[8:9])
+	fmt.Fprintf(&b, "p':              %d [% x]\n", hdr.pp, data[9:10])
+	fmt.Fprintf(&b, "sparseLength:    %d [% x]\n", hdr.sparseLength, data[10:14])
+	fmt.Fprintf(&b, "bitsPerRegister: %d [% x]\n", hdr.bitsPerRegister, data[14:15])
+
+	return b.String(), nil
+}
+
+// ToBase64 returns h marshaled (see Marshal) and encoded with standard base64.
+func ToBase64(h *HLLPP) string {
+	return base64.StdEncoding.EncodeToString(h.Marshal())
+}
+
+// FromBase64 decodes a string returned by ToBase64 back into an HLLPP object.
+// Base64 decoding errors wrap the base64 package's error, and unmarshaling
+// errors are returned as is from Unmarshal.
+func FromBase64(s string) (*HLLPP, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %w", err)
+	}
+	return Unmarshal(data)
+}
+
+// textBytesPerLine is how many data bytes MarshalText puts on each line.
+const textBytesPerLine = 32
+
+// MarshalText implements encoding.TextMarshaler. The result is a human
+// readable version of Marshal's output, one header field per line followed by
+// the data in hex, meant for bug reports and diffs rather than storage:
+//
+//	version: 1
+//	flags: 0x0001
+//	p: 14
+//	p': 20
+//	sparseLength: 3
+//	bitsPerRegister: 0
+//	data:
+//	e2c739e8c50fe68e28
+func (h *HLLPP) MarshalText() ([]byte, error) {
+	data := h.Marshal()
+	hdr, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "version: %d\n", hdr.version)
+	fmt.Fprintf(&b, "flags: %#04x\n", hdr.flags)
+	fmt.Fprintf(&b, "p: %d\n", hdr.p)
+	fmt.Fprintf(&b, "p': %d\n", hdr.pp)
+	fmt.Fprintf(&b, "sparseLength: %d\n", hdr.sparseLength)
+	fmt.Fprintf(&b, "bitsPerRegister: %d\n", hdr.bitsPerRegister)
+	b.WriteString("data:\n")
+
+	for payload := data[marshalHeaderSize:]; len(payload) > 0; {
+		n := textBytesPerLine
+		if n > len(payload) {
+			n = len(payload)
+		}
+		b.WriteString(hex.EncodeToString(payload[:n]))
+		b.WriteByte('\n')
+		payload = payload[n:]
+	}
+
+	return []byte(b.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, replacing h with the
+// estimator described by text as returned by MarshalText.
+func (h *HLLPP) UnmarshalText(text []byte) error {
+	lines := strings.Split(strings.TrimSpace(string(text)), "\n")
+
+	fields := make(map[string]uint64)
+	for len(lines) > 0 {
+		line := strings.TrimSpace(lines[0])
+		lines = lines[1:]
+
+		if line == "data:" {
+			break
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("invalid line %q", line)
+		}
+
+		n, err := strconv.ParseUint(strings.TrimSpace(value), 0, 32)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		fields[key] = n
+	}
+
+	data := make([]byte, marshalHeaderSize)
+	for _, line := range lines {
+		decoded, err := hex.DecodeString(strings.TrimSpace(line))
+		if err != nil {
+			return fmt.Errorf("invalid data: %w", err)
+		}
+		data = append(data, decoded...)
+	}
+
+	for _, key := range []string{"version", "flags", "p", "p'", "sparseLength", "bitsPerRegister"} {
+		if _, ok := fields[key]; !ok {
+			return fmt.Errorf("missing %s", key)
+		}
+	}
+
+	binary.BigEndian.PutUint16(data[0:], uint16(fields["version"]))
+	binary.BigEndian.PutUint32(data[2:], uint32(len(data)))
+	binary.BigEndian.PutUint16(data[6:], uint16(fields["flags"]))
+	data[8] = uint8(fields["p"])
+	data[9] = uint8(fields["p'"])
+	binary.BigEndian.PutUint32(data[10:], uint32(fields["sparseLength"]))
+	data[14] = uint8(fields["bitsPerRegister"])
+
+	uh, err := Unmarshal(data)
+	if err != nil {
+		return err
+	}
+
+	*h = *uh
+	return nil
+}
@@ -4,12 +4,24 @@
 package hllpp
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
 func hllpEqual(h1, h2 HLLPP) bool {
+	// ignore the Count cache
+	h1.version, h1.countVersion, h1.cachedCount = 0, 0, 0
+	h2.version, h2.countVersion, h2.cachedCount = 0, 0, 0
 	return reflect.DeepEqual(h1, h2)
 }
 
@@ -88,3 +100,720 @@ func TestUnmarshalErrors(t *testing.T) {
 		t.Error("Expected nil hll and some error")
 	}
 }
+
+func TestUnmarshalVersion(t *testing.T) {
+	h := New()
+	for i := uint64(0); i < 1000; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	data := h.Marshal()
+	if binary.BigEndian.Uint16(data) != 1 {
+		t.Fatalf("expected version 1, got %d", binary.BigEndian.Uint16(data))
+	}
+
+	uh, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uh.Count() != h.Count() {
+		t.Errorf("got %d, expected %d", uh.Count(), h.Count())
+	}
+
+	// version 2 rejects flags it doesn't know
+	binary.BigEndian.PutUint16(data, 2)
+	binary.BigEndian.PutUint16(data[6:], marshalFlagSparse|1<<10)
+	if _, err := Unmarshal(data); err == nil {
+		t.Error("expected error for unknown flag")
+	}
+	if _, err := CountFromMarshaled(data); err == nil {
+		t.Error("expected CountFromMarshaled error for unknown flag")
+	}
+
+	binary.BigEndian.PutUint16(data, 999)
+	uh, err = Unmarshal(data)
+	if uh != nil || !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expected ErrVersionMismatch, got %v", err)
+	}
+}
+
+func TestMarshalCompactDense(t *testing.T) {
+	h := New()
+	for i := uint64(0); i < 500; i++ {
+		h.Add(intToBytes(i))
+	}
+	h.Add(intToBytes(murmurRho32))
+	h.flushTmpSet()
+	h.toNormal()
+
+	// only MarshalCompact stores the registers compactly
+	if data := h.Marshal(); binary.BigEndian.Uint16(data) != 1 {
+		t.Errorf("expected version 1, got %d", binary.BigEndian.Uint16(data))
+	}
+
+	data := h.MarshalCompact()
+	if binary.BigEndian.Uint16(data) != 2 {
+		t.Errorf("expected version 2, got %d", binary.BigEndian.Uint16(data))
+	}
+
+	if len(data) >= marshalHeaderSize+len(h.data) {
+		t.Errorf("compact size %d not smaller than %d", len(data), marshalHeaderSize+len(h.data))
+	}
+
+	uh, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hllpEqual(*h, *uh) {
+		t.Errorf("got %+v, expected %+v", uh, h)
+	}
+
+	// fully dense still uses version 1
+	for i := uint64(0); i < 100000; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	data = h.MarshalCompact()
+	if binary.BigEndian.Uint16(data) != 1 {
+		t.Errorf("expected version 1, got %d", binary.BigEndian.Uint16(data))
+	}
+
+	if err := marshalUnmarshal(h); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBase64(t *testing.T) {
+	h := New()
+	for i := uint64(0); i < 100000; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	uh, err := FromBase64(ToBase64(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !hllpEqual(*h, *uh) {
+		t.Error("base64 round trip changed HLLPP")
+	}
+
+	var corrupt base64.CorruptInputError
+	if _, err := FromBase64("not base64!"); !errors.As(err, &corrupt) {
+		t.Errorf("expected base64 error, got %v", err)
+	}
+
+	if _, err := FromBase64(base64.StdEncoding.EncodeToString([]byte{0, 99, 0})); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expected ErrVersionMismatch, got %v", err)
+	}
+}
+
+func TestDebugHeader(t *testing.T) {
+	h, err := NewWithConfig(Config{Precision: 12, SparsePrecision: 18})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < 100; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	data := h.Marshal()
+	dump, err := DebugHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, exp := range []string{
+		"version:         1 [00 01]\n",
+		fmt.Sprintf("length:          %d", len(data)),
+		"  sparse:        true\n",
+		"  compact dense: false\n",
+		"p:               12 [0c]\n",
+		"p':              18 [12]\n",
+		fmt.Sprintf("sparseLength:    %d", h.sparseLength),
+		"bitsPerRegister: 0 [00]\n",
+	} {
+		if !strings.Contains(dump, exp) {
+			t.Errorf("expected %q in:\n%s", exp, dump)
+		}
+	}
+
+	if _, err := DebugHeader(data[:10]); err == nil {
+		t.Error("expected error for short data")
+	}
+}
+
+func TestSketchFileReader(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		counts []uint64
+	)
+	for n := uint64(0); n < 5; n++ {
+		h := New()
+		for i := uint64(0); i < n*n*1000; i++ {
+			h.Add(intToBytes(i))
+		}
+		counts = append(counts, h.Count())
+		buf.Write(h.Marshal())
+	}
+
+	data := buf.Bytes()
+
+	r := NewSketchFileReader(bytes.NewReader(data))
+	for i, exp := range counts {
+		h, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Count() != exp {
+			t.Errorf("%d: got %d, expected %d", i, h.Count(), exp)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	// skip every other one, both seeking and not
+	for _, reader := range []io.Reader{bytes.NewReader(data), bytes.NewBuffer(data)} {
+		r = NewSketchFileReader(reader)
+		for i, exp := range counts {
+			if i%2 == 0 {
+				if err := r.Skip(); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+
+			h, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Count() != exp {
+				t.Errorf("%d: got %d, expected %d", i, h.Count(), exp)
+			}
+		}
+		if err := r.Skip(); err != io.EOF {
+			t.Errorf("expected EOF, got %v", err)
+		}
+	}
+
+	r = NewSketchFileReader(bytes.NewReader(data[:len(data)-1]))
+	var err error
+	for err == nil {
+		_, err = r.Next()
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF, got %v", err)
+	}
+
+	// skipping a truncated record, both seeking and not
+	for _, reader := range []io.Reader{bytes.NewReader(data[:len(data)-1]), bytes.NewBuffer(data[:len(data)-1])} {
+		r = NewSketchFileReader(reader)
+		for err = nil; err == nil; {
+			err = r.Skip()
+		}
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%T: expected unexpected EOF, got %v", reader, err)
+		}
+	}
+}
+
+func TestUnmarshalBitsPerRegister(t *testing.T) {
+	sparse := New()
+	sparse.Add([]byte("foo"))
+
+	dense := New()
+	for i := uint64(0); i < 100000; i++ {
+		dense.Add(intToBytes(i))
+	}
+
+	for _, c := range []struct {
+		h    *HLLPP
+		bits byte
+	}{
+		{sparse, 5},
+		{sparse, 6},
+		{dense, 0},
+		{dense, 4},
+		{dense, 7},
+	} {
+		data := c.h.Marshal()
+		data[14] = c.bits
+
+		if _, err := Unmarshal(data); err == nil || !strings.Contains(err.Error(), "bits per register") {
+			t.Errorf("sparse=%v, bits=%d: expected error, got %v", c.h.sparse, c.bits, err)
+		}
+	}
+}
+
+func TestUnmarshalBatch(t *testing.T) {
+	var blobs [][]byte
+	for n := uint64(0); n < 4; n++ {
+		h := New()
+		for i := uint64(0); i < n*10000; i++ {
+			h.Add(intToBytes(i))
+		}
+		blobs = append(blobs, h.Marshal())
+	}
+
+	hs, err := UnmarshalBatch(blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, h := range hs {
+		exp, _ := Unmarshal(blobs[i])
+		if !hllpEqual(*h, *exp) {
+			t.Errorf("%d: mismatch", i)
+		}
+	}
+
+	blobs[2] = blobs[2][:20]
+	hs, err = UnmarshalBatch(blobs)
+	if hs != nil || err == nil || !strings.Contains(err.Error(), "blob 2") {
+		t.Errorf("expected error for blob 2, got %v", err)
+	}
+}
+
+func TestMarshalFolded(t *testing.T) {
+	for _, count := range []uint64{1000, 500000} {
+		h, err := NewWithConfig(Config{Precision: 16})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := uint64(0); i < count; i++ {
+			h.Add(intToBytes(i))
+		}
+
+		before := h.Count()
+
+		data, err := h.MarshalFolded(12)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h.p != 16 || h.Count() != before {
+			t.Error("h was modified")
+		}
+
+		uh, err := Unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		folded := h.clone()
+		folded.fold(12)
+
+		if uh.p != 12 || uh.Count() != folded.Count() {
+			t.Errorf("count %d: got p=%d count %d, expected p=12 count %d", count, uh.p, uh.Count(), folded.Count())
+		}
+
+		if len(data) >= len(h.Marshal()) && !h.sparse {
+			t.Errorf("count %d: folded size %d not smaller than %d", count, len(data), len(h.Marshal()))
+		}
+
+		if e := estimateError(uh.Count(), count); e > 0.05 {
+			t.Errorf("Got %d, expected %d (%f)", uh.Count(), count, e)
+		}
+	}
+
+	if _, err := New().MarshalFolded(15); err == nil {
+		t.Error("expected error folding up")
+	}
+}
+
+func TestCountFromMarshaled(t *testing.T) {
+	h := New()
+	for _, count := range []uint64{0, 10, 1000, 5000, 100000} {
+		for i := uint64(0); i < count; i++ {
+			h.Add(intToBytes(i))
+		}
+
+		data := h.Marshal()
+
+		uh, err := Unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := CountFromMarshaled(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != uh.Count() {
+			t.Errorf("count %d (sparse: %v): got %d, expected %d", count, h.sparse, got, uh.Count())
+		}
+	}
+
+	// compact dense
+	h = New()
+	for i := uint64(0); i < 500; i++ {
+		h.Add(intToBytes(i))
+	}
+	h.flushTmpSet()
+	h.toNormal()
+
+	got, err := CountFromMarshaled(h.MarshalCompact())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != h.Count() {
+		t.Errorf("compact: got %d, expected %d", got, h.Count())
+	}
+
+	if _, err := CountFromMarshaled(h.MarshalCompact()[:20]); err == nil {
+		t.Error("expected error for truncated data")
+	}
+}
+
+func TestMarshalText(t *testing.T) {
+	h, err := NewWithConfig(Config{TrackVolume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, count := range []uint64{0, 100, 500, 100000} {
+		for i := uint64(0); i < count; i++ {
+			h.Add(intToBytes(i))
+		}
+
+		text, err := h.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var uh HLLPP
+		if err := uh.UnmarshalText(text); err != nil {
+			t.Fatalf("count %d: %s\n%s", count, err, text)
+		}
+
+		if !bytes.Equal(uh.Marshal(), h.Marshal()) || !hllpEqual(*h, uh) {
+			t.Errorf("count %d: round trip changed HLLPP", count)
+		}
+	}
+
+	text, _ := New().MarshalText()
+	if !strings.HasPrefix(string(text), "version: 1\nflags: 0x0001\np: 14\np': 20\n") {
+		t.Errorf("unexpected text:\n%s", text)
+	}
+
+	var uh HLLPP
+	for _, bad := range []string{
+		"version: 1\n",
+		strings.Replace(string(text), "p: 14", "p: x", 1),
+		string(text) + "zz\n",
+	} {
+		if err := uh.UnmarshalText([]byte(bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestSparseEntriesFromMarshaled(t *testing.T) {
+	h, err := NewWithConfig(Config{TrackVolume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, count := range []uint64{0, 10, 1000} {
+		for i := uint64(0); i < count; i++ {
+			h.Add(intToBytes(i))
+		}
+
+		data := h.Marshal()
+
+		got, err := SparseEntriesFromMarshaled(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exp, err := h.SparseIndexes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("count %d: got %v, expected %v", count, got, exp)
+		}
+	}
+
+	for i := uint64(0); i < 100000; i++ {
+		h.Add(intToBytes(i))
+	}
+	if _, err := SparseEntriesFromMarshaled(h.Marshal()); err == nil {
+		t.Error("expected error for dense data")
+	}
+
+	if _, err := SparseEntriesFromMarshaled([]byte{0, 99}); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expected ErrVersionMismatch, got %v", err)
+	}
+
+	// ends in a truncated varint
+	data := append(New().Marshal(), 0x80)
+	binary.BigEndian.PutUint32(data[2:], uint32(len(data)))
+	if _, err := SparseEntriesFromMarshaled(data); err == nil {
+		t.Error("expected error for truncated data")
+	}
+}
+
+func TestMarshalMinHash(t *testing.T) {
+	h := MustNewWithConfig(Config{MinHashSize: 100, TrackVolume: true})
+	for _, count := range []uint64{0, 50, 1000, 100000} {
+		for i := uint64(0); i < count; i++ {
+			h.Add(intToBytes(i))
+		}
+
+		if err := marshalUnmarshal(h); err != nil {
+			t.Errorf("count %d: %s", count, err)
+		}
+
+		data := h.Marshal()
+		got, err := CountFromMarshaled(data)
+		if err != nil || got != h.Count() {
+			t.Errorf("count %d: got %d, %v", count, got, err)
+		}
+
+		if h.sparse {
+			if _, err := SparseEntriesFromMarshaled(data); err != nil {
+				t.Errorf("count %d: %s", count, err)
+			}
+		}
+	}
+
+	data := h.Marshal()
+	binary.BigEndian.PutUint16(data[len(data)-4:], 101)
+	if _, err := Unmarshal(data); err == nil {
+		t.Error("expected error for too many hashes")
+	}
+}
+
+func TestMarshalBanks(t *testing.T) {
+	for _, banks := range []int{2, 4, 8} {
+		h := MustNewWithConfig(Config{Precision: 6, Banks: banks})
+		for i := uint64(0); i < 10000; i++ {
+			h.Add(intToBytes(i))
+		}
+
+		data := h.Marshal()
+		got, err := Unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got.banks) != banks-1 {
+			t.Fatalf("%d banks: got %d banks", banks, len(got.banks)+1)
+		}
+		for i, bank := range got.banks {
+			if !bytes.Equal(bank.data, h.banks[i].data) {
+				t.Errorf("%d banks: bank %d differs", banks, i+1)
+			}
+		}
+
+		if got.Count() != h.Count() {
+			t.Errorf("%d banks: got count %d, expected %d", banks, got.Count(), h.Count())
+		}
+		if count, err := CountFromMarshaled(data); err != nil || count != h.Count() {
+			t.Errorf("%d banks: got count %d from marshaled, expected %d (%v)", banks, count, h.Count(), err)
+		}
+
+		// still mergeable with the original
+		if err := got.Merge(h); err != nil {
+			t.Error(err)
+		}
+
+		// truncated banks
+		bad := append(data[:len(data)-7:len(data)-7], data[len(data)-6:]...)
+		binary.BigEndian.PutUint32(bad[2:], uint32(len(bad)))
+		if _, err := Unmarshal(bad); err == nil {
+			t.Errorf("%d banks: expected error for truncated banks", banks)
+		}
+	}
+}
+
+func TestCheckpointMarshal(t *testing.T) {
+	for _, c := range []Config{
+		{},
+		{TrackVolume: true, MinHashSize: 100},
+		// folds from p=16 to p=12 along the way
+		{Precision: 16, MaxBytes: 4096},
+	} {
+		h := MustNewWithConfig(c)
+
+		var (
+			n      uint64
+			blobs  [][]byte
+			sparse []bool
+		)
+		for _, count := range []uint64{0, 100, 100, 50000, 1000, 0} {
+			for i := uint64(0); i < count; i++ {
+				h.Add(intToBytes(n))
+				n++
+			}
+			// repeats only change volume
+			h.Add(intToBytes(0))
+
+			data, err := h.CheckpointMarshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			blobs = append(blobs, data)
+			sparse = append(sparse, h.sparse)
+
+			got, err := Replay(blobs[0], blobs[1:]...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Marshal(), h.Marshal()) {
+				t.Fatalf("%+v: replay after %d values differs", c, n)
+			}
+		}
+
+		// deltas for a few more values are small, sparse or dense (volume
+		// counters are always marshaled in full)
+		for i := 1; i < len(blobs) && !c.TrackVolume; i++ {
+			if i != 3 && len(blobs[i]) > 2000 {
+				t.Errorf("%+v: delta %d is %d bytes (sparse: %v)", c, i, len(blobs[i]), sparse[i])
+			}
+		}
+	}
+
+	// resetting lowers registers, which a delta can't express
+	for _, count := range []uint64{100, 100000} {
+		h := New()
+		for i := uint64(0); i < count; i++ {
+			h.Add(intToBytes(i))
+		}
+		base, err := h.CheckpointMarshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h.ResetDense()
+		for i := uint64(0); i < 10; i++ {
+			h.Add(intToBytes(i + 1000000))
+		}
+		data, err := h.CheckpointMarshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := Replay(base, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Marshal(), h.Marshal()) || got.Count() != h.Count() {
+			t.Errorf("count %d: replay after reset got %d, expected %d", count, got.Count(), h.Count())
+		}
+	}
+
+	// deltas aren't whole estimators
+	h := New()
+	for i := uint64(0); i < 100; i++ {
+		h.Add(intToBytes(i))
+	}
+	base, err := h.CheckpointMarshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < 10; i++ {
+		h.Add(intToBytes(i + 1000))
+	}
+	delta, err := h.CheckpointMarshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Unmarshal(delta); err == nil {
+		t.Error("expected Unmarshal error for delta")
+	}
+	if _, err := CountFromMarshaled(delta); err == nil {
+		t.Error("expected CountFromMarshaled error for delta")
+	}
+	if _, err := UnmarshalBatch([][]byte{base, delta}); err == nil {
+		t.Error("expected UnmarshalBatch error for delta")
+	}
+	if err := NewKeyedAggregator().Add("foo", delta); err == nil {
+		t.Error("expected KeyedAggregator error for delta")
+	}
+	if _, err := Replay(delta); err == nil {
+		t.Error("expected error for delta as base")
+	}
+	if got, err := Replay(base, delta); err != nil || got.Count() != h.Count() {
+		t.Errorf("got %v, %v, expected count %d", got, err, h.Count())
+	}
+
+	banked := MustNewWithConfig(Config{Banks: 2})
+	if _, err := banked.CheckpointMarshal(); err == nil {
+		t.Error("expected error for banks")
+	}
+}
+
+var updateGolden = flag.Bool("update-golden", false, "regenerate testdata/golden (only for new cases; see TestGoldenMarshal)")
+
+// goldenCases build the estimators whose marshaled forms are checked in
+// under testdata/golden.
+var goldenCases = []struct {
+	name  string
+	c     Config
+	n     uint64
+	count uint64
+}{
+	{"sparse", Config{}, 1000, 1000},
+	{"dense", Config{}, 100000, 99895},
+	{"dense_compact", Config{StartDense: true}, 100, 100},
+	{"dense_p10", Config{Precision: 10, SparsePrecision: 20}, 50000, 50214},
+	{"sparse_volume", Config{TrackVolume: true}, 1000, 1000},
+	{"sparse_minhash", Config{MinHashSize: 100}, 1000, 1000},
+	{"dense_volume_minhash", Config{TrackVolume: true, MinHashSize: 100}, 100000, 99895},
+}
+
+// TestGoldenMarshal checks that data marshaled by earlier versions of this
+// package still unmarshals to the same estimator. A failure means the
+// marshal format changed incompatibly: don't regenerate the existing files
+// to fix it, but keep unmarshaling the old format (or bump the marshal
+// version). Run with -update-golden to write the files for new cases, and
+// copy the logged counts into goldenCases.
+func TestGoldenMarshal(t *testing.T) {
+	for _, gc := range goldenCases {
+		path := filepath.Join("testdata", "golden", gc.name+".bin")
+
+		if *updateGolden {
+			h := MustNewWithConfig(gc.c)
+			for i := uint64(0); i < gc.n; i++ {
+				h.Add(intToBytes(i))
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, h.MarshalCompact(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("%s: count %d", gc.name, h.Count())
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h, err := Unmarshal(data)
+		if err != nil {
+			t.Fatalf("%s: %s", gc.name, err)
+		}
+
+		if got := h.Count(); got != gc.count {
+			t.Errorf("%s: got count %d, expected %d", gc.name, got, gc.count)
+		}
+
+		// and it is the same as an estimator built from scratch today
+		exp := MustNewWithConfig(gc.c)
+		for i := uint64(0); i < gc.n; i++ {
+			exp.Add(intToBytes(i))
+		}
+		if got, err := Unmarshal(exp.Marshal()); err != nil || !hllpEqual(*got, *h) {
+			t.Errorf("%s: golden data differs from a new estimator", gc.name)
+		}
+	}
+}
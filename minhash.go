@@ -0,0 +1,184 @@
+// Copyright (c) 2018, RetailNext, Inc.
+// All rights reserved.
+
+package hllpp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// addMinHash records the hash x of an added value if it is among the
+// minHashK smallest seen so far.
+func (h *HLLPP) addMinHash(x uint64) {
+	n := len(h.minHash)
+	if n == h.minHashK && x >= h.minHash[n-1] {
+		return
+	}
+
+	i := sort.Search(n, func(i int) bool { return h.minHash[i] >= x })
+	if i < n && h.minHash[i] == x {
+		return
+	}
+
+	if n == h.minHashK {
+		h.minHash = h.minHash[:n-1]
+	}
+
+	h.minHash = append(h.minHash, 0)
+	copy(h.minHash[i+1:], h.minHash[i:])
+	h.minHash[i] = x
+}
+
+// mergeMinHash returns the k smallest distinct hashes in a and b, which must
+// both be sorted.
+func mergeMinHash(a, b []uint64, k int) []uint64 {
+	merged := make([]uint64, 0, k)
+	for len(merged) < k && (len(a) > 0 || len(b) > 0) {
+		var x uint64
+		switch {
+		case len(b) == 0 || len(a) > 0 && a[0] < b[0]:
+			x, a = a[0], a[1:]
+		case len(a) == 0 || b[0] < a[0]:
+			x, b = b[0], b[1:]
+		default:
+			x, a, b = a[0], a[1:], b[1:]
+		}
+		merged = append(merged, x)
+	}
+	return merged
+}
+
+// mergeMinHashFrom updates h's MinHash to be that of the union of h and
+// other. If other doesn't have one, the union's smallest hashes are unknown,
+// so h's is dropped. If the sizes differ, the smaller one is kept.
+func (h *HLLPP) mergeMinHashFrom(other *HLLPP) {
+	if other.minHashK == 0 {
+		h.minHashK, h.minHash = 0, nil
+		return
+	}
+
+	if other.minHashK < h.minHashK {
+		h.minHashK = other.minHashK
+	}
+	h.minHash = mergeMinHash(h.minHash, other.minHash, h.minHashK)
+}
+
+// IntersectionCount estimates the number of distinct values added to both h
+// and other, via inclusion-exclusion: Count(h) + Count(other) - Count(h ∪
+// other), clamped to 0. This is inaccurate when the intersection is small
+// compared to the union. If both h and other were created with
+// Config.MinHashSize, the Jaccard similarity of their MinHash sketches times
+// Count(h ∪ other) is used instead whenever its expected error is smaller
+// (and if neither has seen more distinct values than the MinHash size, the
+// intersection is counted exactly). h and other are not modified, except
+// that their buffered sparse values may be flushed. h and other must have the
+// same p and p' values.
+func (h *HLLPP) IntersectionCount(other *HLLPP) (uint64, error) {
+	union := h.clone()
+	if err := union.Merge(other); err != nil {
+		return 0, err
+	}
+
+	hCount, otherCount, unionCount := h.Count(), other.Count(), union.Count()
+
+	var ie uint64
+	if hCount+otherCount > unionCount {
+		ie = hCount + otherCount - unionCount
+	}
+
+	if h.minHashK == 0 || other.minHashK == 0 {
+		return ie, nil
+	}
+
+	k := h.minHashK
+	if other.minHashK < k {
+		k = other.minHashK
+	}
+
+	hMin, otherMin := h.minHash, other.minHash
+	if len(hMin) > k {
+		hMin = hMin[:k]
+	}
+	if len(otherMin) > k {
+		otherMin = otherMin[:k]
+	}
+
+	// count the union's smallest hashes that are in both
+	unionMin := mergeMinHash(hMin, otherMin, k)
+	var both int
+	for _, x := range unionMin {
+		i := sort.Search(len(hMin), func(i int) bool { return hMin[i] >= x })
+		j := sort.Search(len(otherMin), func(i int) bool { return otherMin[i] >= x })
+		if i < len(hMin) && hMin[i] == x && j < len(otherMin) && otherMin[j] == x {
+			both++
+		}
+	}
+
+	// every value is in the MinHash sketches, so the intersection is exact
+	if len(hMin) < k && len(otherMin) < k {
+		return uint64(both), nil
+	}
+
+	if len(unionMin) == 0 {
+		return ie, nil
+	}
+
+	jaccard := float64(both) / float64(len(unionMin))
+	a, b, u := float64(hCount), float64(otherCount), float64(unionCount)
+	ieErr := h.RelativeError() * math.Sqrt(a*a+b*b+u*u)
+
+	mhErr := u * math.Sqrt(jaccard*(1-jaccard)/float64(len(unionMin)))
+
+	if mhErr < ieErr {
+		return uint64(jaccard*float64(unionCount) + 0.5), nil
+	}
+	return ie, nil
+}
+
+// appendMinHash appends the marshaled MinHash (the hashes, followed by their
+// number and k) to data.
+func appendMinHash(data []byte, k int, hashes []uint64) []byte {
+	var buf [8]byte
+	for _, x := range hashes {
+		binary.BigEndian.PutUint64(buf[:], x)
+		data = append(data, buf[:]...)
+	}
+	return append(data, byte(len(hashes)>>8), byte(len(hashes)), byte(k>>8), byte(k))
+}
+
+// splitMinHash decodes the MinHash at the end of payload, and removes it from
+// payload.
+func splitMinHash(payload *[]byte) (k int, hashes []uint64, _ error) {
+	if len(*payload) < 4 {
+		return 0, nil, fmt.Errorf("data too short for MinHash (%d bytes)", len(*payload))
+	}
+
+	trailer := (*payload)[len(*payload)-4:]
+	n, k := int(binary.BigEndian.Uint16(trailer)), int(binary.BigEndian.Uint16(trailer[2:]))
+	if k == 0 || n > k {
+		return 0, nil, fmt.Errorf("invalid MinHash size %d of %d", n, k)
+	}
+
+	if len(*payload) < 4+8*n {
+		return 0, nil, fmt.Errorf("data too short for MinHash (%d bytes)", len(*payload))
+	}
+
+	encoded := (*payload)[len(*payload)-4-8*n:]
+	*payload = (*payload)[:len(*payload)-4-8*n]
+
+	if n > 0 {
+		hashes = make([]uint64, n)
+		for i := range hashes {
+			hashes[i] = binary.BigEndian.Uint64(encoded[8*i:])
+			if i > 0 && hashes[i] <= hashes[i-1] {
+				return 0, nil, errors.New("MinHash not sorted")
+			}
+		}
+	}
+
+	return k, hashes, nil
+}
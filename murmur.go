@@ -136,20 +136,22 @@ func murmurSum64(data []byte) uint64 {
 	h1 += h2
 	h2 += h1
 
-	h1 ^= h1 >> 33
-	h1 *= 0xff51afd7ed558ccd
-	h1 ^= h1 >> 33
-	h1 *= 0xc4ceb9fe1a85ec53
-	h1 ^= h1 >> 33
-
-	h2 ^= h2 >> 33
-	h2 *= 0xff51afd7ed558ccd
-	h2 ^= h2 >> 33
-	h2 *= 0xc4ceb9fe1a85ec53
-	h2 ^= h2 >> 33
+	h1 = murmurFmix64(h1)
+	h2 = murmurFmix64(h2)
 
 	h1 += h2
 	h2 += h1
 
 	return h1
 }
+
+// murmurFmix64 is murmur3's 64 bit finalizer, which mixes the bits of k so
+// each input bit affects every output bit.
+func murmurFmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2018, RetailNext, Inc.
+// All rights reserved.
+
+package hllpp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// SketchFileReader reads HLLPP objects marshaled back-to-back (e.g. in a
+// file) one at a time, using the length in each marshal header to find where
+// the next one starts. It is not safe to use from multiple goroutines at once.
+type SketchFileReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+// NewSketchFileReader creates a SketchFileReader reading from r. If r is also
+// an io.Seeker, Skip seeks past records instead of reading them.
+func NewSketchFileReader(r io.Reader) *SketchFileReader {
+	return &SketchFileReader{r: r}
+}
+
+// frame reads the version and length at the start of the next record, and
+// returns the record's total length. It returns io.EOF if there are no more
+// records.
+func (s *SketchFileReader) frame() (uint32, error) {
+	var prefix [6]byte
+	if _, err := io.ReadFull(s.r, prefix[:]); err != nil {
+		return 0, err
+	}
+
+	length := binary.BigEndian.Uint32(prefix[2:])
+	if length < marshalHeaderSize {
+		return 0, fmt.Errorf("invalid record length: %d", length)
+	}
+
+	s.buf = append(s.buf[:0], prefix[:]...)
+	return length, nil
+}
+
+// Next reads and unmarshals the next record. It returns io.EOF when there are
+// no more records, and io.ErrUnexpectedEOF if the last record is truncated.
+func (s *SketchFileReader) Next() (*HLLPP, error) {
+	length, err := s.frame()
+	if err != nil {
+		return nil, err
+	}
+
+	if cap(s.buf) < int(length) {
+		s.buf = append(make([]byte, 0, length), s.buf...)
+	}
+	s.buf = s.buf[:length]
+
+	if _, err := io.ReadFull(s.r, s.buf[6:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return Unmarshal(s.buf)
+}
+
+// Skip moves past the next record without unmarshaling it. It returns io.EOF
+// when there are no more records, and io.ErrUnexpectedEOF if the last record
+// is truncated.
+func (s *SketchFileReader) Skip() error {
+	length, err := s.frame()
+	if err != nil {
+		return err
+	}
+
+	rest := int64(length) - 6
+	if seeker, ok := s.r.(io.Seeker); ok {
+		// seeking past the end isn't an error, so check against the size
+		pos, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if pos+rest > end {
+			return io.ErrUnexpectedEOF
+		}
+
+		_, err = seeker.Seek(pos+rest, io.SeekStart)
+		return err
+	}
+
+	if _, err := io.CopyN(io.Discard, s.r, rest); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
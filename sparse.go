@@ -5,6 +5,8 @@ package hllpp
 
 import (
 	"encoding/binary"
+	"errors"
+	"math"
 	"sort"
 )
 
@@ -50,6 +52,21 @@ func (iter *sparseReader) Done() bool {
 	return iter.idx >= len(iter.data)
 }
 
+// sparseDataLength returns the number of entries in the sparse data, or an
+// error if it contains an invalid or truncated varint, which sparseReader
+// would never get past.
+func sparseDataLength(data []byte) (uint32, error) {
+	var length uint32
+	for i := 0; i < len(data); length++ {
+		_, n := binary.Uvarint(data[i:])
+		if n <= 0 {
+			return 0, errors.New("invalid sparse data")
+		}
+		i += n
+	}
+	return length, nil
+}
+
 type sparseWriter struct {
 	data []byte
 
@@ -86,6 +103,16 @@ func (writer *sparseWriter) Append(k, idx uint32, rho uint8) {
 	writer.currRho = rho
 }
 
+// AppendDistinct appends k, whose index must be bigger than the index of every
+// value appended so far, so there is no need to dedupe.
+func (writer *sparseWriter) AppendDistinct(k uint32) {
+	if writer.hasCurrVal {
+		writer.commit()
+	}
+	writer.currVal = k
+	writer.commit()
+}
+
 func (writer *sparseWriter) commit() {
 	n := binary.PutUvarint(writer.varIntBuf[:], uint64(writer.currVal-writer.lastVal))
 	writer.data = append(writer.data, writer.varIntBuf[:n]...)
@@ -127,18 +154,122 @@ func (h *HLLPP) flushTmpSet() {
 }
 
 func (h *HLLPP) mergeSparse(tmpSet []uint32) {
+	if h.onSparseUpdate != nil {
+		h.notifySparseUpdates(tmpSet)
+	}
 
-	iter := newSparseReader(h.data)
 	writer := newSparseWriter()
 
-	var tmpI int
-
 	// deduping by index and choosing biggest rho is handled in the writer
+	h.mergeSparseData(h.data, tmpSet, writer.Append)
+
+	h.setSparseData(writer)
+}
+
+// mergeSparseStream merges other's sparse data (which must have the same p and
+// p' as h) into h's. Both are already sorted by index, so this is a single
+// pass over both encoded streams, only decoding rho for indexes in both.
+func (h *HLLPP) mergeSparseStream(other []byte) {
+	writer := newSparseWriter()
+
+	iter, otherIter := sparseReader{data: h.data}, sparseReader{data: other}
+	for !iter.Done() || !otherIter.Done() {
+		var idx, otherIdx uint32
+		if !iter.Done() {
+			idx = h.getIndex(iter.Peek(), h.pp)
+		}
+		if !otherIter.Done() {
+			otherIdx = h.getIndex(otherIter.Peek(), h.pp)
+		}
+
+		switch {
+		case otherIter.Done() || !iter.Done() && idx < otherIdx:
+			writer.AppendDistinct(iter.Next())
+		case iter.Done() || otherIdx < idx:
+			k := otherIter.Next()
+			if h.onSparseUpdate != nil {
+				_, rho := h.decodeHash(k, h.pp)
+				h.onSparseUpdate(otherIdx, 0, rho)
+			}
+			writer.AppendDistinct(k)
+		default:
+			k, otherK := iter.Next(), otherIter.Next()
+			_, rho := h.decodeHash(k, h.pp)
+			if _, otherRho := h.decodeHash(otherK, h.pp); otherRho > rho {
+				if h.onSparseUpdate != nil {
+					h.onSparseUpdate(idx, rho, otherRho)
+				}
+				k = otherK
+			}
+			writer.AppendDistinct(k)
+		}
+	}
+
+	h.setSparseData(writer)
+}
+
+// setSparseData replaces h's sparse data with writer's, converting to dense if
+// it is too big.
+func (h *HLLPP) setSparseData(writer *sparseWriter) {
+	h.data = writer.Bytes()
+	h.sparseLength = writer.Len()
+	h.version++
+
+	if h.sparseTooBig() {
+		h.toNormal()
+	}
+}
+
+// sparseTooBig reports whether the sparse data is bigger than dense data
+// would be.
+func (h *HLLPP) sparseTooBig() bool {
+	return uint32(len(h.data))*8 >= 6*h.m
+}
+
+// notifySparseUpdates calls onSparseUpdate for each index in tmpSet (which
+// must be sorted by index) that is not in the sparse data or has a bigger rho
+// than in the sparse data.
+func (h *HLLPP) notifySparseUpdates(tmpSet []uint32) {
+	reader := sparseReader{data: h.data}
+
+	for i := 0; i < len(tmpSet); {
+		idx, rho := h.decodeHash(tmpSet[i], h.pp)
+
+		// pick the biggest rho among duplicate indexes
+		for i++; i < len(tmpSet) && h.getIndex(tmpSet[i], h.pp) == idx; i++ {
+			if _, r := h.decodeHash(tmpSet[i], h.pp); r > rho {
+				rho = r
+			}
+		}
+
+		for !reader.Done() && h.getIndex(reader.Peek(), h.pp) < idx {
+			reader.Advance()
+		}
+
+		var old uint8
+		if !reader.Done() && h.getIndex(reader.Peek(), h.pp) == idx {
+			_, old = h.decodeHash(reader.Peek(), h.pp)
+		}
+
+		if rho > old {
+			h.onSparseUpdate(idx, old, rho)
+		}
+	}
+}
+
+// mergeSparseData merges the sparse data with tmpSet (which must be sorted by
+// index), calling fn with each value and its p' index and rho in index order.
+// Values with the same index may be passed more than once in a row, so fn is
+// responsible for picking the one with the biggest rho.
+func (h *HLLPP) mergeSparseData(data []byte, tmpSet []uint32, fn func(k, idx uint32, rho uint8)) {
+	iter := sparseReader{data: data}
+
+	var tmpI int
 
 	for !iter.Done() || tmpI < len(tmpSet) {
 		if iter.Done() {
 			idx, rho := h.decodeHash(tmpSet[tmpI], h.pp)
-			writer.Append(tmpSet[tmpI], idx, rho)
+			fn(tmpSet[tmpI], idx, rho)
 			tmpI++
 			continue
 		}
@@ -147,7 +278,7 @@ func (h *HLLPP) mergeSparse(tmpSet []uint32) {
 		sparseIdx, sparseR := h.decodeHash(sparseVal, h.pp)
 
 		if tmpI == len(tmpSet) {
-			writer.Append(sparseVal, sparseIdx, sparseR)
+			fn(sparseVal, sparseIdx, sparseR)
 			iter.Advance()
 			continue
 		}
@@ -156,29 +287,199 @@ func (h *HLLPP) mergeSparse(tmpSet []uint32) {
 		tmpIdx, tmpR := h.decodeHash(tmpVal, h.pp)
 
 		if sparseIdx < tmpIdx {
-			writer.Append(sparseVal, sparseIdx, sparseR)
+			fn(sparseVal, sparseIdx, sparseR)
 			iter.Advance()
 		} else if sparseIdx > tmpIdx {
-			writer.Append(tmpVal, tmpIdx, tmpR)
+			fn(tmpVal, tmpIdx, tmpR)
 			tmpI++
 		} else {
 			if sparseR > tmpR {
-				writer.Append(sparseVal, sparseIdx, sparseR)
+				fn(sparseVal, sparseIdx, sparseR)
 			} else {
-				writer.Append(tmpVal, tmpIdx, tmpR)
+				fn(tmpVal, tmpIdx, tmpR)
 			}
 			iter.Advance()
 			tmpI++
 		}
 	}
+}
 
-	h.data = writer.Bytes()
-	h.sparseLength = writer.Len()
+// sortTmpSet sorts tmpSet by index in place without allocating. tmpSet is
+// small, so insertion sort is good enough.
+func (h *HLLPP) sortTmpSet() {
+	for i := 1; i < len(h.tmpSet); i++ {
+		k := h.tmpSet[i]
+		idx := h.getIndex(k, h.pp)
 
-	// is sparse data bigger than dense data would be?
-	if uint32(len(h.data))*8 >= 6*h.m {
-		h.toNormal()
+		j := i
+		for ; j > 0 && h.getIndex(h.tmpSet[j-1], h.pp) > idx; j-- {
+			h.tmpSet[j] = h.tmpSet[j-1]
+		}
+		h.tmpSet[j] = k
+	}
+}
+
+// hasSparseIndex reports whether the sparse data or tmpSet has a value with
+// p' index idx.
+func (h *HLLPP) hasSparseIndex(idx uint32) bool {
+	for _, k := range h.tmpSet {
+		if h.getIndex(k, h.pp) == idx {
+			return true
+		}
+	}
+
+	// the sparse data is sorted by index
+	reader := sparseReader{data: h.data}
+	for !reader.Done() {
+		if i := h.getIndex(reader.Next(), h.pp); i >= idx {
+			return i == idx
+		}
+	}
+	return false
+}
+
+// pendingSparse computes what the sparse data would look like after flushing
+// tmpSet, without flushing it or allocating (tmpSet is sorted in place). It
+// returns the number of sparse entries, as well as the register sum and the
+// number of zero registers at precision p (see registerSum).
+func (h *HLLPP) pendingSparse() (length uint32, sum float64, numZeros uint32) {
+	h.sortTmpSet()
+
+	var (
+		numSet  uint32
+		currIdx uint32
+		currReg uint32
+		currRho uint8
+	)
+	h.mergeSparseData(h.data, h.tmpSet, func(k, idx uint32, rho uint8) {
+		if length == 0 || idx != currIdx {
+			length++
+			currIdx = idx
+		}
+
+		// entries for the same register (p index) are adjacent
+		reg := idx >> (h.pp - h.p)
+		if currRho > 0 && reg == currReg {
+			if rho > currRho {
+				currRho = rho
+			}
+			return
+		}
+		if currRho > 0 {
+			sum += 1.0 / float64(uint64(1)<<currRho)
+			numSet++
+		}
+		currReg, currRho = reg, rho
+	})
+	if currRho > 0 {
+		sum += 1.0 / float64(uint64(1)<<currRho)
+		numSet++
 	}
+
+	numZeros = h.m - numSet
+	return length, sum + float64(numZeros), numZeros
+}
+
+// DistinctSparseIndexes returns the exact number of distinct p' indexes among
+// the values added to h, or 0 if h is dense. Values only collide if their
+// hashes share the same top p' bits, so for cardinalities well below 2^(p'/2)
+// this is very likely to be the exact number of distinct values added (e.g.
+// for p'=25, a few hundred distinct values have well under a 1% chance of any
+// collision). Buffered values are counted without flushing them.
+func (h *HLLPP) DistinctSparseIndexes() uint32 {
+	if !h.sparse {
+		return 0
+	}
+
+	length, _, _ := h.pendingSparse()
+	return length
+}
+
+// SparseIndexes returns the distinct p' indexes of the values added to h, in
+// ascending order. h must be sparse.
+func (h *HLLPP) SparseIndexes() ([]uint32, error) {
+	if h.sparse {
+		h.flushTmpSet()
+	}
+
+	if !h.sparse {
+		return nil, errors.New("HLLPP is dense")
+	}
+
+	indexes := make([]uint32, 0, h.sparseLength)
+	reader := sparseReader{data: h.data}
+	for !reader.Done() {
+		indexes = append(indexes, h.getIndex(reader.Next(), h.pp))
+	}
+	return indexes, nil
+}
+
+// SparseIntersectionCount returns the number of p' indexes h and other have in
+// common, which for low cardinalities is very likely to be the exact number
+// of distinct values added to both (see DistinctSparseIndexes). This is much
+// more accurate than inclusion-exclusion. The sparse data is already sorted
+// by index, so this is a single linear pass over both. h and other must both
+// be sparse, and have the same p and p' values.
+func (h *HLLPP) SparseIntersectionCount(other *HLLPP) (uint64, error) {
+	if h.p != other.p || h.pp != other.pp {
+		return 0, errors.New("HLLPPs have different parameters")
+	}
+
+	if h.sparse {
+		h.flushTmpSet()
+	}
+
+	if other.sparse {
+		other.flushTmpSet()
+	}
+
+	if !h.sparse || !other.sparse {
+		return 0, errors.New("HLLPPs must both be sparse")
+	}
+
+	var (
+		count uint64
+		hIter = sparseReader{data: h.data}
+		oIter = sparseReader{data: other.data}
+	)
+	for !hIter.Done() && !oIter.Done() {
+		hIdx, oIdx := h.getIndex(hIter.Peek(), h.pp), other.getIndex(oIter.Peek(), other.pp)
+		switch {
+		case hIdx < oIdx:
+			hIter.Advance()
+		case hIdx > oIdx:
+			oIter.Advance()
+		default:
+			count++
+			hIter.Advance()
+			oIter.Advance()
+		}
+	}
+
+	return count, nil
+}
+
+// EncodeSparse returns the value h stores in its sparse representation for
+// the 64-bit hash x. The top p' bits of x are the index. If bits p..p' of x
+// are all zero, rho' (the number of leading zeros after the first p' bits,
+// plus one) is also stored, and the value is laid out as
+//
+//	index<<7 | rho'<<1 | 1
+//
+// Otherwise rho can be recovered from the index, and the value is just
+//
+//	index << 1
+//
+// This layout is part of the marshal format, so it will only change along
+// with the marshal version.
+func (h *HLLPP) EncodeSparse(x uint64) uint32 {
+	return h.encodeHash(x)
+}
+
+// DecodeSparse returns the register index (with respect to p) and register
+// value (rho) corresponding to k, a value returned by EncodeSparse.
+func (h *HLLPP) DecodeSparse(k uint32) (index uint32, rho uint8) {
+	return h.decodeHash(k, h.p)
 }
 
 func (h *HLLPP) encodeHash(x uint64) uint32 {
@@ -210,3 +511,94 @@ func (h *HLLPP) getIndex(k uint32, p uint8) uint32 {
 		return sliceBits32(k, h.pp, 1+h.pp-p)
 	}
 }
+
+// EstimatedSparseCapacityRemaining estimates how many more distinct values
+// can be added to h before it converts to the dense representation. The
+// estimate is based on the space left before the sparse data reaches the
+// size of the dense data, divided by the expected average size of a sparse
+// entry at that point. It is approximate, and returns 0 if h is already
+// dense.
+func (h *HLLPP) EstimatedSparseCapacityRemaining() uint64 {
+	if !h.sparse {
+		return 0
+	}
+
+	h.flushTmpSet()
+	if !h.sparse {
+		return 0
+	}
+
+	limit := 6 * h.m / 8
+	used := uint32(len(h.data))
+	if used >= limit {
+		return 0
+	}
+
+	return uint64(float64(limit-used) / h.sparseEntrySizeAtCapacity())
+}
+
+// RecommendSparsePrecision returns the highest (most accurate) p' for
+// precision p that should keep an estimator sparse up to about
+// targetSparseCardinality distinct values, based on
+// EstimatedSparseCapacityRemaining. A higher p' makes sparse entries bigger,
+// so if no p' reaches the target, the one with the most sparse capacity is
+// returned. The result is in the range [p..25]; p must be a valid precision.
+func RecommendSparsePrecision(p uint8, targetSparseCardinality uint64) uint8 {
+	best, bestCapacity := p, uint64(0)
+	for pp := 25; pp >= int(p); pp-- {
+		h, err := NewWithConfig(Config{Precision: p, SparsePrecision: uint8(pp)})
+		if err != nil {
+			continue
+		}
+
+		capacity := h.EstimatedSparseCapacityRemaining()
+		if capacity >= targetSparseCardinality {
+			return uint8(pp)
+		}
+
+		if capacity > bestCapacity {
+			best, bestCapacity = uint8(pp), capacity
+		}
+	}
+
+	return best
+}
+
+// Expected average size in bytes of a sparse entry once the sparse data is
+// as big as the dense data would be. Sparse values are delta encoded as
+// varints, and the deltas are roughly exponentially distributed, so the
+// average entry shrinks as more entries are added. Entries that need to
+// store rho are much bigger than their neighbors, which costs roughly two
+// extra varints each.
+func (h *HLLPP) sparseEntrySizeAtCapacity() float64 {
+	span := math.Ldexp(1, int(h.pp)+1)
+	withRho := math.Ldexp(1, -int(h.pp-h.p))
+	if h.pp == h.p {
+		// every entry stores rho, so they are all the same size
+		span = math.Ldexp(1, int(h.pp)+7)
+		withRho = 0
+	}
+
+	avgSize := func(n float64) float64 {
+		size := 1.0
+		for x := 128.0; x < math.MaxUint32; x *= 128 {
+			size += math.Exp(-x * n / span)
+		}
+		return size + withRho*8
+	}
+
+	// find the number of entries n that fill the dense size (n*avgSize(n) is
+	// increasing in n)
+	limit := float64(6 * h.m / 8)
+	lo, hi := 1.0, limit
+	for hi-lo > 1 {
+		mid := math.Floor((lo + hi) / 2)
+		if mid*avgSize(mid) < limit {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	return avgSize(lo)
+}
@@ -4,7 +4,11 @@
 package hllpp
 
 import (
+	"bytes"
+	"fmt"
+	"math"
 	"math/rand"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -94,3 +98,260 @@ func TestSparseMerge(t *testing.T) {
 		}
 	}
 }
+
+func TestEstimatedSparseCapacityRemaining(t *testing.T) {
+	h := New()
+
+	initial := h.EstimatedSparseCapacityRemaining()
+	if initial < 5000 || initial > 10000 {
+		t.Errorf("got %d", initial)
+	}
+
+	last := initial
+	var i uint64
+	for ; h.sparse; i++ {
+		h.Add(intToBytes(i))
+
+		if i%100 != 0 {
+			continue
+		}
+
+		remaining := h.EstimatedSparseCapacityRemaining()
+		if !h.sparse {
+			break
+		}
+
+		if remaining > last {
+			t.Fatalf("%d: remaining capacity went up from %d to %d", i, last, remaining)
+		}
+		last = remaining
+	}
+
+	// close to 0 right before conversion
+	if last > initial/20 {
+		t.Errorf("expected ~0 before conversion, got %d", last)
+	}
+
+	// and the initial estimate wasn't far off
+	if e := estimateError(initial, i); e > 0.15 {
+		t.Errorf("estimated %d, converted at %d (%f)", initial, i, e)
+	}
+
+	if r := h.EstimatedSparseCapacityRemaining(); r != 0 {
+		t.Errorf("got %d", r)
+	}
+}
+
+func TestDistinctSparseIndexes(t *testing.T) {
+	h, err := NewWithConfig(Config{SparsePrecision: 25})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := uint64(0); i < 300; i++ {
+		h.Add(intToBytes(i))
+		h.Add(intToBytes(i))
+
+		if got := h.DistinctSparseIndexes(); got != uint32(i+1) {
+			t.Fatalf("got %d, expected %d", got, i+1)
+		}
+	}
+
+	for i := uint64(300); i < 100000; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	if got := h.DistinctSparseIndexes(); got != 0 {
+		t.Errorf("got %d for dense", got)
+	}
+}
+
+func TestSparseIntersectionCount(t *testing.T) {
+	var sparseErr, inclExclErr float64
+
+	for trial := uint64(0); trial < 20; trial++ {
+		h, err := NewWithConfig(Config{SparsePrecision: 25})
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := NewWithConfig(Config{SparsePrecision: 25})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := uint64(0); i < 1500; i++ {
+			h.Add(intToBytes(trial<<32 | i))
+			other.Add(intToBytes(trial<<32 | (i + 1000)))
+		}
+
+		got, err := h.SparseIntersectionCount(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sparseErr += math.Abs(float64(got) - 500)
+
+		union, err := Combine(h, other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inclExcl := float64(h.Count()) + float64(other.Count()) - float64(union.Count())
+		inclExclErr += math.Abs(inclExcl - 500)
+	}
+
+	// at p'=25 collisions are rare enough to get the exact overlap
+	if sparseErr > 0 {
+		t.Errorf("total error %f (inclusion-exclusion %f)", sparseErr, inclExclErr)
+	}
+
+	dense := New()
+	for i := uint64(0); i < 100000; i++ {
+		dense.Add(intToBytes(i))
+	}
+	if _, err := New().SparseIntersectionCount(dense); err == nil {
+		t.Error("expected error for dense")
+	}
+}
+
+func TestSparseIndexes(t *testing.T) {
+	h := New()
+	for i := uint64(0); i < 2000; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	indexes, err := h.SparseIndexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uint32(len(indexes)) != h.DistinctSparseIndexes() {
+		t.Errorf("got %d indexes, expected %d", len(indexes), h.DistinctSparseIndexes())
+	}
+
+	for i := 1; i < len(indexes); i++ {
+		if indexes[i] <= indexes[i-1] {
+			t.Fatalf("%d: %d not after %d", i, indexes[i], indexes[i-1])
+		}
+	}
+
+	for i := uint64(0); i < 100000; i++ {
+		h.Add(intToBytes(i))
+	}
+
+	if _, err := h.SparseIndexes(); err == nil {
+		t.Error("expected error for dense")
+	}
+}
+
+func TestRecommendSparsePrecision(t *testing.T) {
+	for _, target := range []uint64{500, 2000, 6000} {
+		pp := RecommendSparsePrecision(14, target)
+		if pp < 14 || pp > 25 {
+			t.Fatalf("target %d: got p'=%d", target, pp)
+		}
+
+		h, err := NewWithConfig(Config{Precision: 14, SparsePrecision: pp})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var i uint64
+		for ; h.sparse; i++ {
+			h.Add(intToBytes(i))
+			if i%10 == 0 {
+				h.flushTmpSet()
+			}
+		}
+
+		// the estimate is approximate, so allow some slack
+		if float64(i) < 0.85*float64(target) {
+			t.Errorf("target %d: p'=%d converted to dense at %d", target, pp, i)
+		}
+
+		// the next p' up wouldn't have made it
+		if pp < 25 {
+			h, _ = NewWithConfig(Config{Precision: 14, SparsePrecision: pp + 1})
+			if c := h.EstimatedSparseCapacityRemaining(); c >= target {
+				t.Errorf("target %d: p'=%d has capacity %d", target, pp+1, c)
+			}
+		}
+	}
+
+	if pp := RecommendSparsePrecision(10, 1e9); pp < 10 || pp > 25 {
+		t.Errorf("got p'=%d", pp)
+	}
+}
+
+// mergeSparseTmpSet merges other's sparse data into h by decoding it into a
+// tmpSet, which is how Merge used to do it.
+func mergeSparseTmpSet(h, other *HLLPP) {
+	tmpSet := make([]uint32, 0, other.sparseLength)
+	reader := sparseReader{data: other.data}
+	for !reader.Done() {
+		tmpSet = append(tmpSet, reader.Next())
+	}
+	h.mergeSparse(tmpSet)
+}
+
+func TestMergeSparseStream(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	// a small p' so indexes often collide with different rhos
+	c := Config{Precision: 10, SparsePrecision: 13}
+
+	for iter := 0; iter < 200; iter++ {
+		h, other := MustNewWithConfig(c), MustNewWithConfig(c)
+		for i := rng.Intn(200); i > 0; i-- {
+			h.Add(intToBytes(rng.Uint64() % 300))
+		}
+		for i := rng.Intn(200); i > 0; i-- {
+			other.Add(intToBytes(rng.Uint64() % 300))
+		}
+		h.flushTmpSet()
+		other.flushTmpSet()
+
+		var updates, expUpdates []string
+		exp := h.clone()
+		exp.onSparseUpdate = func(index uint32, old, new uint8) {
+			expUpdates = append(expUpdates, fmt.Sprint(index, old, new))
+		}
+		mergeSparseTmpSet(exp, other)
+
+		h.onSparseUpdate = func(index uint32, old, new uint8) {
+			updates = append(updates, fmt.Sprint(index, old, new))
+		}
+		if err := h.Merge(other); err != nil {
+			t.Fatal(err)
+		}
+
+		if h.sparse != exp.sparse || !bytes.Equal(h.data, exp.data) || h.sparseLength != exp.sparseLength {
+			t.Fatalf("%d: merged data differs", iter)
+		}
+
+		if !reflect.DeepEqual(updates, expUpdates) {
+			t.Fatalf("%d: got updates %v, expected %v", iter, updates, expUpdates)
+		}
+	}
+}
+
+func benchmarkMergeSparse(b *testing.B, merge func(h, other *HLLPP)) {
+	h, other := New(), New()
+	for i := uint64(0); i < 2000; i++ {
+		h.Add(intToBytes(i))
+		other.Add(intToBytes(i + 1000))
+	}
+	h.flushTmpSet()
+	other.flushTmpSet()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := h.clone()
+		merge(c, other)
+	}
+}
+
+func BenchmarkMergeSparseStream(b *testing.B) {
+	benchmarkMergeSparse(b, func(h, other *HLLPP) { h.mergeSparseStream(other.data) })
+}
+
+func BenchmarkMergeSparseTmpSet(b *testing.B) {
+	benchmarkMergeSparse(b, mergeSparseTmpSet)
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2018, RetailNext, Inc.
+// All rights reserved.
+
+package hllpp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// UnionView is a read-only view of the union of several HLLPP objects. Count
+// computes the union's estimate in a single pass over the members' data,
+// without merging them into a new estimator (see Materialize). The members
+// are referenced, not copied, so changes to them are reflected in the view.
+type UnionView struct {
+	hs []*HLLPP
+}
+
+// NewUnionView creates a UnionView of hs, which must all have the same p and
+// p' values, and can't use banks.
+func NewUnionView(hs ...*HLLPP) (*UnionView, error) {
+	if len(hs) == 0 {
+		return nil, errors.New("no HLLPPs")
+	}
+
+	for _, h := range hs {
+		if h.p != hs[0].p || h.pp != hs[0].pp {
+			return nil, errors.New("HLLPPs have different parameters")
+		}
+		if h.banks != nil {
+			return nil, errors.New("UnionView does not support banks")
+		}
+	}
+
+	return &UnionView{hs: hs}, nil
+}
+
+// Count returns the same value as Count would for the members merged
+// together, using the first member's Config. Like Merge, it flushes values
+// buffered by sparse members.
+func (u *UnionView) Count() uint64 {
+	first := u.hs[0]
+
+	for _, h := range u.hs {
+		if h.sparse {
+			h.flushTmpSet()
+		}
+	}
+
+	data, ok := u.sparseMembers()
+	if !ok {
+		return first.estimate(u.denseSum())
+	}
+
+	length, size, sum, numZeros := u.sparseUnion(data)
+
+	// merging would have converted to dense if the sparse data got too big
+	if size*8 < 6*first.m && !first.rawEstimateOnly {
+		return first.linearCounting(first.mp, first.mp-length)
+	}
+	return first.estimate(sum, numZeros)
+}
+
+// Materialize merges the members into a new HLLPP.
+func (u *UnionView) Materialize() (*HLLPP, error) {
+	h := u.hs[0].clone()
+	for _, other := range u.hs[1:] {
+		if err := h.Merge(other); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// sparseMembers returns the sparse data each member contributes to the union
+// if merging the members in order would leave the result sparse, or false if
+// it would be dense. Like Merge, mostly empty dense members are converted to
+// sparse values for the registers bigger than in the members before them
+// (see sparseFromDense), unless there is no sparse data yet to merge them
+// into.
+func (u *UnionView) sparseMembers() ([][]byte, bool) {
+	first := u.hs[0]
+
+	data := make([][]byte, len(u.hs))
+
+	// the biggest value of each register in the members so far, only needed
+	// once there is a dense member
+	var registers []uint8
+
+	empty := true
+	for i, h := range u.hs {
+		if h.sparse {
+			data[i] = h.data
+			empty = empty && len(h.data) == 0
+			if registers != nil {
+				sparseRegisters(first, registers, h.data)
+			}
+			continue
+		}
+
+		if empty {
+			return nil, false
+		}
+
+		if _, ok := h.mostlyEmptyDense(); !ok {
+			return nil, false
+		}
+
+		if registers == nil {
+			registers = make([]uint8, first.m)
+			for _, prev := range data[:i] {
+				sparseRegisters(first, registers, prev)
+			}
+		}
+
+		writer := newSparseWriter()
+		for reg := uint32(0); reg < h.m; reg++ {
+			rho := getRegister(h.data, h.bitsPerRegister, reg)
+			if rho <= registers[reg] {
+				continue
+			}
+			registers[reg] = rho
+			writer.AppendDistinct(first.encodeHash(first.registerHash(reg, rho)))
+		}
+		data[i] = writer.Bytes()
+	}
+
+	return data, true
+}
+
+// sparseRegisters raises registers to the values implied by the sparse data.
+func sparseRegisters(h *HLLPP, registers []uint8, data []byte) {
+	reader := sparseReader{data: data}
+	for !reader.Done() {
+		if idx, rho := h.decodeHash(reader.Next(), h.p); rho > registers[idx] {
+			registers[idx] = rho
+		}
+	}
+}
+
+// sparseUnion walks the union of the members' sparse data (see
+// sparseMembers) in index order, returning the number of entries and encoded
+// size in bytes the merged sparse data would have, as well as the register
+// sum and number of zero registers at precision p (see registerSum).
+func (u *UnionView) sparseUnion(data [][]byte) (length, size uint32, sum float64, numZeros uint32) {
+	first := u.hs[0]
+
+	readers := make([]sparseReader, len(data))
+	for i, d := range data {
+		readers[i] = sparseReader{data: d}
+	}
+
+	var (
+		varIntBuf [binary.MaxVarintLen32]byte
+		lastVal   uint32
+		numSet    uint32
+		currReg   uint32
+		currRho   uint8
+	)
+	for {
+		// find the smallest index, and the value with the biggest rho for it
+		var (
+			found bool
+			idx   uint32
+			val   uint32
+			rho   uint8
+		)
+		for i := range readers {
+			if readers[i].Done() {
+				continue
+			}
+			k := readers[i].Peek()
+			kIdx, kRho := first.decodeHash(k, first.pp)
+			if !found || kIdx < idx || kIdx == idx && kRho > rho {
+				found, idx, val, rho = true, kIdx, k, kRho
+			}
+		}
+		if !found {
+			break
+		}
+
+		for i := range readers {
+			if !readers[i].Done() && first.getIndex(readers[i].Peek(), first.pp) == idx {
+				readers[i].Advance()
+			}
+		}
+
+		length++
+		size += uint32(binary.PutUvarint(varIntBuf[:], uint64(val-lastVal)))
+		lastVal = val
+
+		// entries for the same register (p index) are adjacent
+		reg := idx >> (first.pp - first.p)
+		if currRho > 0 && reg == currReg {
+			if rho > currRho {
+				currRho = rho
+			}
+			continue
+		}
+		if currRho > 0 {
+			sum += 1.0 / float64(uint64(1)<<currRho)
+			numSet++
+		}
+		currReg, currRho = reg, rho
+	}
+	if currRho > 0 {
+		sum += 1.0 / float64(uint64(1)<<currRho)
+		numSet++
+	}
+
+	numZeros = first.m - numSet
+	return length, size, sum + float64(numZeros), numZeros
+}
+
+// denseSum returns the register sum and number of zero registers of the
+// union (see registerSum), taking the biggest value of each register across
+// dense and sparse members.
+func (u *UnionView) denseSum() (sum float64, numZeros uint32) {
+	first := u.hs[0]
+
+	readers := make([]sparseReader, len(u.hs))
+	for i, h := range u.hs {
+		if h.sparse {
+			readers[i] = sparseReader{data: h.data}
+		}
+	}
+
+	for reg := uint32(0); reg < first.m; reg++ {
+		var rho uint8
+		for i, h := range u.hs {
+			if !h.sparse {
+				if r := getRegister(h.data, h.bitsPerRegister, reg); r > rho {
+					rho = r
+				}
+				continue
+			}
+
+			// sparse data is sorted by index, so this register's entries
+			// are next
+			for !readers[i].Done() && h.getIndex(readers[i].Peek(), h.p) == reg {
+				if _, r := h.decodeHash(readers[i].Next(), h.p); r > rho {
+					rho = r
+				}
+			}
+		}
+
+		sum += 1.0 / float64(uint64(1)<<rho)
+		if rho == 0 {
+			numZeros++
+		}
+	}
+
+	return sum, numZeros
+}